@@ -1,7 +1,13 @@
 package cmd
 
 import (
+	"os"
+
+	"github.com/hooksie1/piggybank/service"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var clientCmd = &cobra.Command{
@@ -20,3 +26,32 @@ func bindClientCmdFlags(cmd *cobra.Command, args []string) {
 	bindNatsFlags(cmd)
 	bindClientFlags(cmd)
 }
+
+// readSeed returns the key pair from an nkey seed file, or nil if no path is set
+func readSeed(path string) (nkeys.KeyPair, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return nkeys.ParseDecoratedNKey(contents)
+}
+
+// newClient returns a client that signs admin requests and verifies responses when configured
+func newClient(nc *nats.Conn) (service.Client, error) {
+	kp, err := readSeed(viper.GetString("admin_seed_file"))
+	if err != nil {
+		return service.Client{}, err
+	}
+
+	return service.Client{
+		Conn:       nc,
+		AdminKey:   kp,
+		ServiceKey: viper.GetString("service_key"),
+		Timeout:    viper.GetDuration("timeout"),
+	}, nil
+}
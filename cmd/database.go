@@ -2,10 +2,12 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/hooksie1/piggybank/service"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"golang.org/x/term"
 )
 
 var databaseCmd = &cobra.Command{
@@ -19,8 +21,51 @@ var databaseCmd = &cobra.Command{
 
 func init() {
 	clientCmd.AddCommand(databaseCmd)
-	databaseCmd.Flags().String("key", "", "Database key")
+	databaseCmd.Flags().String("key", "", "Database key or unseal share")
 	viper.BindPFlag("key", databaseCmd.Flags().Lookup("key"))
+	databaseCmd.Flags().Int("shares", 0, "Number of shares to split the database key into on init or rekey")
+	viper.BindPFlag("shares", databaseCmd.Flags().Lookup("shares"))
+	databaseCmd.Flags().Int("threshold", 0, "Number of shares required to unlock the database on init or rekey")
+	viper.BindPFlag("threshold", databaseCmd.Flags().Lookup("threshold"))
+	databaseCmd.Flags().String("algorithm", "", fmt.Sprintf("Cipher used to seal secrets on init or migrate, one of %v", service.GetCipherIDs()))
+	viper.BindPFlag("algorithm", databaseCmd.Flags().Lookup("algorithm"))
+	databaseCmd.Flags().Bool("passphrase", false, "Prompt for a passphrase to protect the database key on init or to unlock, lock, migrate and rotate with")
+	viper.BindPFlag("passphrase", databaseCmd.Flags().Lookup("passphrase"))
+	databaseCmd.Flags().StringSlice("current-shares", nil, "Current unseal shares to lock, migrate, rotate or rekey with")
+	viper.BindPFlag("current-shares", databaseCmd.Flags().Lookup("current-shares"))
+	databaseCmd.Flags().Bool("new-passphrase", false, "Prompt for a new passphrase to protect the database key on rekey")
+	viper.BindPFlag("new-passphrase", databaseCmd.Flags().Lookup("new-passphrase"))
+}
+
+// readPassphrase prompts for a passphrase on the terminal without echoing it
+func readPassphrase(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+
+	return string(passphrase), nil
+}
+
+// newPassphraseInit prompts for a new passphrase twice and returns it when both match
+func newPassphraseInit() (string, error) {
+	passphrase, err := readPassphrase("New passphrase: ")
+	if err != nil {
+		return "", err
+	}
+
+	confirm, err := readPassphrase("Confirm passphrase: ")
+	if err != nil {
+		return "", err
+	}
+
+	if passphrase != confirm {
+		return "", fmt.Errorf("passphrases do not match")
+	}
+
+	return passphrase, nil
 }
 
 func database(cmd *cobra.Command, args []string) error {
@@ -33,26 +78,111 @@ func database(cmd *cobra.Command, args []string) error {
 		return err
 	}
 	key := viper.GetString("key")
+	usePassphrase := viper.GetBool("passphrase")
 
-	if args[0] == "unlock" && key == "" {
-		return fmt.Errorf("database key required")
+	// without a key the database can only be unlocked with a passphrase
+	if args[0] == service.DBUnlock.String() && key == "" {
+		usePassphrase = true
 	}
 
-	client := service.Client{
-		Conn: nc,
+	client, err := newClient(nc)
+	if err != nil {
+		return err
 	}
 
-	request, err := service.NewDBRequest(service.DBVerb(args[0]), key)
+	request, err := databaseRequest(args[0], key, usePassphrase)
 	if err != nil {
 		return err
 	}
 
-	resp, err := client.Do(request)
+	resp, err := client.DoResponse(request)
 	if err != nil {
 		return err
 	}
 
-	fmt.Println(resp)
+	fmt.Println(resp.Details)
+	for _, v := range resp.Shares {
+		fmt.Println(v)
+	}
 
 	return nil
 }
+
+// databaseRequest returns the request for the database verb with the unseal material and options from the flags
+func databaseRequest(verb, key string, usePassphrase bool) (service.Request, error) {
+	request, err := service.NewDBRequest(service.DBVerb(verb), key)
+	if err != nil {
+		return service.Request{}, err
+	}
+
+	switch verb {
+	case service.DBInit.String():
+		var passphrase string
+		if usePassphrase {
+			passphrase, err = newPassphraseInit()
+			if err != nil {
+				return service.Request{}, err
+			}
+		}
+		request, err = service.NewInitRequest(service.InitRequest{
+			Shares:     viper.GetInt("shares"),
+			Threshold:  viper.GetInt("threshold"),
+			Passphrase: passphrase,
+			Algorithm:  viper.GetString("algorithm"),
+		})
+	case service.DBUnlock.String():
+		if !usePassphrase {
+			break
+		}
+		var passphrase string
+		passphrase, err = readPassphrase("Passphrase: ")
+		if err != nil {
+			return service.Request{}, err
+		}
+		request, err = service.NewPassphraseRequest(service.DBVerb(verb), passphrase)
+	case service.DBLock.String(), service.DBMigrate.String(), service.DBRotate.String():
+		// rotate always needs the unseal material, without an admin key lock and migrate need it too
+		material := service.RotateRequest{
+			CurrentKey:    key,
+			CurrentShares: viper.GetStringSlice("current-shares"),
+		}
+		if usePassphrase {
+			material.Passphrase, err = readPassphrase("Passphrase: ")
+			if err != nil {
+				return service.Request{}, err
+			}
+		}
+		switch verb {
+		case service.DBMigrate.String():
+			request, err = service.NewMigrateRequest(service.MigrateRequest{RotateRequest: material, Algorithm: viper.GetString("algorithm")})
+		case service.DBRotate.String():
+			request, err = service.NewRotateRequest(material)
+		default:
+			request, err = service.NewLockRequest(material)
+		}
+	case service.DBRekey.String():
+		rekeyReq := service.RekeyRequest{
+			CurrentKey:    key,
+			CurrentShares: viper.GetStringSlice("current-shares"),
+			New: service.InitRequest{
+				Shares:    viper.GetInt("shares"),
+				Threshold: viper.GetInt("threshold"),
+			},
+		}
+		if usePassphrase {
+			rekeyReq.Passphrase, err = readPassphrase("Current passphrase: ")
+			if err != nil {
+				return service.Request{}, err
+			}
+		}
+		if viper.GetBool("new-passphrase") {
+			rekeyReq.New.Passphrase, err = newPassphraseInit()
+			if err != nil {
+				return service.Request{}, err
+			}
+		}
+		request, err = service.NewRekeyRequest(rekeyReq)
+	}
+
+	return request, err
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"encoding/json"
+	"slices"
+	"testing"
+
+	"github.com/hooksie1/piggybank/service"
+	"github.com/spf13/viper"
+)
+
+func TestDatabaseRequestShares(t *testing.T) {
+	shares := []string{"share1", "share2"}
+	viper.Set("current-shares", shares)
+	t.Cleanup(func() { viper.Set("current-shares", nil) })
+
+	for _, verb := range []service.DBVerb{service.DBRotate, service.DBLock, service.DBMigrate} {
+		t.Run(verb.String(), func(t *testing.T) {
+			request, err := databaseRequest(verb.String(), "", false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if request.Subject != service.SubjectVerbs[verb] {
+				t.Errorf("expected subject %s but got %s", service.SubjectVerbs[verb], request.Subject)
+			}
+
+			var req service.RotateRequest
+			if err := json.Unmarshal(request.Data, &req); err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(req.CurrentShares, shares) {
+				t.Errorf("expected the current shares to be sent but got %v", req.CurrentShares)
+			}
+		})
+	}
+}
@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"time"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -33,8 +35,90 @@ func natsFlags(cmd *cobra.Command) {
 
 func bindClientFlags(cmd *cobra.Command) {
 	viper.BindPFlag("inbox_prefix", cmd.Flags().Lookup("inbox-prefix"))
+	viper.BindPFlag("admin_seed_file", cmd.Flags().Lookup("admin-seed-file"))
+	viper.BindPFlag("service_key", cmd.Flags().Lookup("service-key"))
+	viper.BindPFlag("timeout", cmd.Flags().Lookup("timeout"))
 }
 
 func clientFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().String("inbox-prefix", "PIGGYBANK.ADMIN", "subject prefix for replies")
+	cmd.PersistentFlags().String("admin-seed-file", "", "Path to an nkey seed used to sign init, lock and rotate requests")
+	cmd.PersistentFlags().String("service-key", "", "Public nkey of the service, responses not signed by it are rejected")
+	cmd.PersistentFlags().Duration("timeout", 0, "How long to wait for a response, by default 30s for database requests that may check a passphrase and 1s otherwise")
+}
+
+// bindProviderFlags binds key provider flag values to viper
+func bindProviderFlags(cmd *cobra.Command) {
+	viper.BindPFlag("key_provider", cmd.Flags().Lookup("key-provider"))
+	viper.BindPFlag("key_provider_path", cmd.Flags().Lookup("key-provider-path"))
+	viper.BindPFlag("key_provider_recipients", cmd.Flags().Lookup("key-provider-recipients"))
+}
+
+// providerFlags adds the key provider flags to the passed in cobra command
+func providerFlags(cmd *cobra.Command) {
+	cmd.Flags().String("key-provider", "", "Key provider used to auto unlock the database, one of file or age")
+	cmd.Flags().String("key-provider-path", "", "Path to the key file or age identity file for the key provider")
+	cmd.Flags().String("key-provider-recipients", "", "Path to the age recipients file the database key is encrypted to")
+}
+
+// bindAutoLockFlags binds auto-lock flag values to viper
+func bindAutoLockFlags(cmd *cobra.Command) {
+	viper.BindPFlag("auto_lock_idle", cmd.Flags().Lookup("auto-lock-idle"))
+	viper.BindPFlag("auto_lock_max", cmd.Flags().Lookup("auto-lock-max"))
+	viper.BindPFlag("auto_lock_disconnect", cmd.Flags().Lookup("auto-lock-disconnect"))
+}
+
+// autoLockFlags adds the auto-lock flags to the passed in cobra command
+func autoLockFlags(cmd *cobra.Command) {
+	cmd.Flags().Duration("auto-lock-idle", 0, "Lock the database when no secret has been read for this long, 0 disables it")
+	cmd.Flags().Duration("auto-lock-max", 0, "Lock the database once it has been unlocked for this long, 0 disables it")
+	cmd.Flags().Bool("auto-lock-disconnect", false, "Lock the instance when it is disconnected from NATS")
+}
+
+// bindLockoutFlags binds lockout flag values to viper
+func bindLockoutFlags(cmd *cobra.Command) {
+	viper.BindPFlag("lockout_failures", cmd.Flags().Lookup("lockout-failures"))
+	viper.BindPFlag("lockout_global_failures", cmd.Flags().Lookup("lockout-global-failures"))
+	viper.BindPFlag("lockout_window", cmd.Flags().Lookup("lockout-window"))
+}
+
+// lockoutFlags adds the lockout flags to the passed in cobra command
+func lockoutFlags(cmd *cobra.Command) {
+	cmd.Flags().Int("lockout-failures", 10, "Failed unlock, rotate or rekey attempts in a row from a caller before locking it out, 0 disables the lockout")
+	cmd.Flags().Int("lockout-global-failures", 100, "Failed attempts in a row from every caller before locking out every caller, 0 disables the global lockout")
+	cmd.Flags().Duration("lockout-window", time.Hour, "How long every attempt is rejected after a lockout")
+}
+
+// bindExpiryFlags binds expiry flag values to viper
+func bindExpiryFlags(cmd *cobra.Command) {
+	viper.BindPFlag("expiry_sweep_interval", cmd.Flags().Lookup("expiry-sweep-interval"))
+}
+
+// expiryFlags adds the expiry flags to the passed in cobra command
+func expiryFlags(cmd *cobra.Command) {
+	cmd.Flags().Duration("expiry-sweep-interval", time.Minute, "How often expired secrets are purged, 0 disables the sweeper")
+}
+
+// bindAdminFlags binds admin and response signing flag values to viper
+func bindAdminFlags(cmd *cobra.Command) {
+	viper.BindPFlag("admin_keys", cmd.Flags().Lookup("admin-keys"))
+	viper.BindPFlag("signing_seed_file", cmd.Flags().Lookup("signing-seed-file"))
+}
+
+// bindClusterFlags binds cluster flag values to viper
+func bindClusterFlags(cmd *cobra.Command) {
+	viper.BindPFlag("cluster_seed_file", cmd.Flags().Lookup("cluster-seed-file"))
+	viper.BindPFlag("standalone", cmd.Flags().Lookup("standalone"))
+}
+
+// clusterFlags adds the cluster flags to the passed in cobra command
+func clusterFlags(cmd *cobra.Command) {
+	cmd.Flags().String("cluster-seed-file", "", "Path to an nkey seed used to sign messages between instances, every instance must use the same seed")
+	cmd.Flags().Bool("standalone", false, "Run a single instance without a cluster seed, refused if another instance is running")
+}
+
+// adminFlags adds the admin and response signing flags to the passed in cobra command
+func adminFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSlice("admin-keys", nil, "nkey public keys allowed to sign init, lock and rotate requests")
+	cmd.Flags().String("signing-seed-file", "", "Path to an nkey seed used to sign every response")
 }
@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/hooksie1/piggybank/service"
 	"github.com/spf13/cobra"
@@ -14,7 +16,7 @@ var secretsCmd = &cobra.Command{
 	Short:        "Interact with piggybank secrets",
 	RunE:         secrets,
 	Args:         cobra.MatchAll(cobra.MinimumNArgs(1), cobra.OnlyValidArgs),
-	ValidArgs:    []string{"add", "get", "delete"},
+	ValidArgs:    []string{"add", "get", "delete", "history", "rollback", "meta", "list"},
 	SilenceUsage: true,
 }
 
@@ -22,9 +24,29 @@ func init() {
 	clientCmd.AddCommand(secretsCmd)
 	secretsCmd.Flags().StringP("id", "i", "", "Secret ID")
 	viper.BindPFlag("id", secretsCmd.Flags().Lookup("id"))
-	secretsCmd.MarkFlagRequired("id")
 	secretsCmd.Flags().StringP("value", "v", "", "Secret value")
 	viper.BindPFlag("value", secretsCmd.Flags().Lookup("value"))
+	secretsCmd.Flags().Uint64P("revision", "r", 0, "Revision to get or roll back to, or the expected current revision when adding a secret where 0 requires the secret to not exist")
+	viper.BindPFlag("revision", secretsCmd.Flags().Lookup("revision"))
+	secretsCmd.Flags().String("field", "", "Field of a secret holding a JSON object to get, add or delete")
+	viper.BindPFlag("field", secretsCmd.Flags().Lookup("field"))
+	secretsCmd.Flags().Duration("ttl", 0, "How long until the added secret expires")
+	viper.BindPFlag("ttl", secretsCmd.Flags().Lookup("ttl"))
+	secretsCmd.Flags().String("expires", "", "RFC 3339 time the added secret expires at")
+	viper.BindPFlag("expires", secretsCmd.Flags().Lookup("expires"))
+	secretsCmd.Flags().String("prefix", "", "Prefix of the secrets to list, every secret if empty")
+	viper.BindPFlag("prefix", secretsCmd.Flags().Lookup("prefix"))
+	secretsCmd.Flags().Int("limit", 0, "Number of secrets to list, every secret if 0")
+	viper.BindPFlag("limit", secretsCmd.Flags().Lookup("limit"))
+	secretsCmd.Flags().String("after", "", "List the secrets after this key")
+	viper.BindPFlag("after", secretsCmd.Flags().Lookup("after"))
+	secretsCmd.Flags().Bool("metadata", false, "List the metadata of each secret")
+	viper.BindPFlag("metadata", secretsCmd.Flags().Lookup("metadata"))
+	secretsCmd.Flags().String("description", "", "Description to set in the secret metadata")
+	viper.BindPFlag("description", secretsCmd.Flags().Lookup("description"))
+	secretsCmd.Flags().String("owner", "", "Owner to set in the secret metadata")
+	viper.BindPFlag("owner", secretsCmd.Flags().Lookup("owner"))
+	secretsCmd.Flags().StringToString("labels", nil, "Labels to set in the secret metadata as key=value pairs, replacing the current labels")
 }
 
 func getSubject(verb string, id string) string {
@@ -42,10 +64,43 @@ func secrets(cmd *cobra.Command, args []string) error {
 	}
 	id := viper.GetString("id")
 
-	client := service.Client{Conn: nc}
+	client, err := newClient(nc)
+	if err != nil {
+		return err
+	}
+
+	if id == "" && args[0] != "list" {
+		return fmt.Errorf("id flag is required")
+	}
 
 	switch args[0] {
+	case "list":
+		return listSecrets(&client)
 	case "get":
+		if field := viper.GetString("field"); field != "" {
+			if cmd.Flags().Changed("revision") {
+				return fmt.Errorf("revision flag cannot be combined with field")
+			}
+
+			msg, err := client.GetField(id, field)
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(msg)
+			return nil
+		}
+
+		if cmd.Flags().Changed("revision") {
+			msg, err := client.GetAt(id, viper.GetUint64("revision"))
+			if err != nil {
+				return err
+			}
+
+			fmt.Println(msg)
+			return nil
+		}
+
 		msg, err := client.Get(id)
 		if err != nil {
 			return err
@@ -57,13 +112,104 @@ func secrets(cmd *cobra.Command, args []string) error {
 		if val == "" {
 			return fmt.Errorf("value flag is required to add a secret")
 		}
+
+		expiring := cmd.Flags().Changed("ttl") || cmd.Flags().Changed("expires")
+		if field := viper.GetString("field"); field != "" {
+			if expiring || cmd.Flags().Changed("revision") {
+				return fmt.Errorf("field flag cannot be combined with revision, ttl or expires")
+			}
+
+			revision, err := client.PostField(id, field, []byte(val))
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("successfully stored field at revision %d\n", revision)
+			return nil
+		}
+
+		if expiring && cmd.Flags().Changed("revision") {
+			return fmt.Errorf("revision flag cannot be combined with ttl or expires")
+		}
+
+		if cmd.Flags().Changed("ttl") && cmd.Flags().Changed("expires") {
+			return fmt.Errorf("only one of ttl or expires can be set")
+		}
+
+		if cmd.Flags().Changed("ttl") {
+			revision, err := client.PostTTL(id, []byte(val), viper.GetDuration("ttl"))
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("successfully stored secret at revision %d\n", revision)
+			return nil
+		}
+
+		if cmd.Flags().Changed("expires") {
+			expires, err := time.Parse(time.RFC3339, viper.GetString("expires"))
+			if err != nil {
+				return fmt.Errorf("invalid expires: %w", err)
+			}
+
+			revision, err := client.PostExpires(id, []byte(val), expires)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("successfully stored secret at revision %d\n", revision)
+			return nil
+		}
+
+		if cmd.Flags().Changed("revision") {
+			revision, err := client.PostRevision(id, []byte(val), viper.GetUint64("revision"))
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("successfully stored secret at revision %d\n", revision)
+			return nil
+		}
+
 		msg, err := client.Post(id, []byte(val))
 		if err != nil {
 			return err
 		}
 
 		fmt.Println(msg)
+	case "history":
+		versions, err := client.History(id)
+		if err != nil {
+			return err
+		}
+
+		for _, v := range versions {
+			fmt.Printf("%d\t%s\t%s\n", v.Revision, v.Created.Format(time.RFC3339), v.Operation)
+		}
+	case "rollback":
+		if !cmd.Flags().Changed("revision") {
+			return fmt.Errorf("revision flag is required to roll back a secret")
+		}
+
+		revision, err := client.Rollback(id, viper.GetUint64("revision"))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("rolled back to revision %d, stored as revision %d\n", viper.GetUint64("revision"), revision)
+	case "meta":
+		return secretMetadata(cmd, &client, id)
 	case "delete":
+		if field := viper.GetString("field"); field != "" {
+			revision, err := client.DeleteField(id, field)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("successfully deleted field at revision %d\n", revision)
+			return nil
+		}
+
 		msg, err := client.Delete(id)
 		if err != nil {
 			return err
@@ -74,3 +220,85 @@ func secrets(cmd *cobra.Command, args []string) error {
 
 	return nil
 }
+
+// secretMetadata prints the metadata of the secret, updating it first with any metadata flags that were set
+func secretMetadata(cmd *cobra.Command, client *service.Client, id string) error {
+	var update service.MetadataUpdate
+	changed := false
+	if cmd.Flags().Changed("description") {
+		description := viper.GetString("description")
+		update.Description = &description
+		changed = true
+	}
+	if cmd.Flags().Changed("owner") {
+		owner := viper.GetString("owner")
+		update.Owner = &owner
+		changed = true
+	}
+	if cmd.Flags().Changed("labels") {
+		update.Labels, _ = cmd.Flags().GetStringToString("labels")
+		if update.Labels == nil {
+			update.Labels = map[string]string{}
+		}
+		changed = true
+	}
+
+	var meta service.SecretMetadata
+	var err error
+	if changed {
+		meta, err = client.UpdateMetadata(id, update)
+	} else {
+		meta, err = client.Metadata(id)
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(data))
+
+	return nil
+}
+
+// listSecrets prints the secrets under the prefix flag. Without a limit every page is listed.
+func listSecrets(client *service.Client) error {
+	req := service.ListRequest{
+		After:    viper.GetString("after"),
+		Limit:    viper.GetInt("limit"),
+		Metadata: viper.GetBool("metadata"),
+	}
+
+	for {
+		secrets, next, err := client.List(viper.GetString("prefix"), req)
+		if err != nil {
+			return err
+		}
+
+		for _, v := range secrets {
+			if v.Metadata == nil {
+				fmt.Println(v.Key)
+				continue
+			}
+
+			data, err := json.Marshal(v.Metadata)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\t%s\n", v.Key, data)
+		}
+
+		if next == "" {
+			return nil
+		}
+
+		if viper.GetInt("limit") > 0 {
+			fmt.Printf("more secrets after %s\n", next)
+			return nil
+		}
+		req.After = next
+	}
+}
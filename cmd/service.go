@@ -18,4 +18,10 @@ func init() {
 
 func bindServiceCmdFlags(cmd *cobra.Command, args []string) {
 	bindNatsFlags(cmd)
+	bindProviderFlags(cmd)
+	bindAutoLockFlags(cmd)
+	bindLockoutFlags(cmd)
+	bindExpiryFlags(cmd)
+	bindAdminFlags(cmd)
+	bindClusterFlags(cmd)
 }
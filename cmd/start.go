@@ -9,6 +9,7 @@ import (
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/micro"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var startCmd = &cobra.Command{
@@ -21,6 +22,12 @@ var startCmd = &cobra.Command{
 func init() {
 	// attach start subcommand to service subcommand
 	serviceCmd.AddCommand(startCmd)
+	providerFlags(startCmd)
+	autoLockFlags(startCmd)
+	lockoutFlags(startCmd)
+	expiryFlags(startCmd)
+	adminFlags(startCmd)
+	clusterFlags(startCmd)
 }
 
 func start(cmd *cobra.Command, args []string) error {
@@ -52,8 +59,57 @@ func start(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
-	appCtx := service.AppContext{
-		KV: kv,
+	provider, err := service.NewKeyProvider(viper.GetString("key_provider"), viper.GetString("key_provider_path"), viper.GetString("key_provider_recipients"))
+	if err != nil {
+		return err
+	}
+
+	appCtx := service.NewAppContext(kv)
+	appCtx.Conn = nc
+	appCtx.Provider = provider
+	appCtx.Lockout = service.LockoutPolicy{
+		MaxFailures:       viper.GetInt("lockout_failures"),
+		GlobalMaxFailures: viper.GetInt("lockout_global_failures"),
+		Window:            viper.GetDuration("lockout_window"),
+	}
+	if err := appCtx.Lockout.Validate(); err != nil {
+		return err
+	}
+
+	appCtx.AdminKeys = viper.GetStringSlice("admin_keys")
+	if err := service.ValidateAdminKeys(appCtx.AdminKeys); err != nil {
+		return err
+	}
+
+	appCtx.Signer, err = readSeed(viper.GetString("signing_seed_file"))
+	if err != nil {
+		return err
+	}
+	if appCtx.Signer != nil {
+		if err := service.ValidateSigner(appCtx.Signer); err != nil {
+			return err
+		}
+	}
+
+	appCtx.ClusterKey, err = readSeed(viper.GetString("cluster_seed_file"))
+	if err != nil {
+		return err
+	}
+
+	standalone := viper.GetBool("standalone")
+	if appCtx.ClusterKey == nil && !standalone {
+		return fmt.Errorf("a cluster seed file is required to share the seal state between instances, or run a single instance with --standalone")
+	}
+
+	// a standalone instance does not share its seal state, so it must be the only one serving the bank
+	if standalone {
+		if err := appCtx.CheckStandalone(config.Name); err != nil {
+			return err
+		}
+	}
+
+	if err := appCtx.MigrateSystemKeys(logger); err != nil {
+		return err
 	}
 
 	// uncomment for config watching
@@ -70,12 +126,40 @@ func start(cmd *cobra.Command, args []string) error {
 		logr.Fatal(err)
 	}
 
+	if !standalone {
+		if err := appCtx.JoinCluster(logger); err != nil {
+			return err
+		}
+	}
+
+	policy := service.AutoLockPolicy{
+		Idle:         viper.GetDuration("auto_lock_idle"),
+		MaxUnlocked:  viper.GetDuration("auto_lock_max"),
+		OnDisconnect: viper.GetBool("auto_lock_disconnect"),
+	}
+	stopAutoLock, err := appCtx.StartAutoLock(logger, policy)
+	if err != nil {
+		return err
+	}
+	defer stopAutoLock()
+
+	stopSweeper, err := appCtx.StartExpirySweeper(logger, viper.GetDuration("expiry_sweep_interval"))
+	if err != nil {
+		return err
+	}
+	defer stopSweeper()
+
 	service.DBGroup(svc, logger, appCtx)
 	service.AppGroup(svc, logger, appCtx)
+	service.TransitGroup(svc, logger, appCtx)
 
 	// uncomment to enable config watching
 	//go service.WatchForConfig(logger, js)
 
+	if err := appCtx.AutoUnlock(logger); err != nil {
+		logger.Errorf("auto unlock failed: %v", err)
+	}
+
 	logger.Infof("service %s %s started", svc.Info().Name, svc.Info().ID)
 
 	health := func(ch chan<- string, s micro.Service) {
@@ -85,5 +169,8 @@ func start(cmd *cobra.Command, args []string) error {
 		}
 	}
 
-	return cwnats.HandleNotify(svc, health)
+	err = cwnats.HandleNotify(svc, health)
+	appCtx.Seal()
+
+	return err
 }
@@ -0,0 +1,198 @@
+package service
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	AdminKeyHeader       = "Piggybank-Admin-Key"
+	AdminNonceHeader     = "Piggybank-Admin-Nonce"
+	AdminSignatureHeader = "Piggybank-Admin-Signature"
+	adminKeyPrefix       = systemPrefix + "admin."
+	adminNonceWindow     = time.Minute
+)
+
+// adminSubjects are the database endpoints that require proof of authority
+var adminSubjects = []string{
+	SubjectVerbs[DBInit],
+	SubjectVerbs[DBLock],
+	SubjectVerbs[DBRotate],
+	SubjectVerbs[DBMigrate],
+}
+
+// ValidateAdminKeys checks that every admin key is an nkey public key that can sign
+func ValidateAdminKeys(keys []string) error {
+	for _, v := range keys {
+		if !nkeys.IsValidPublicKey(v) || nkeys.Prefix(v) == nkeys.PrefixByteCurve {
+			return fmt.Errorf("invalid admin key %s", v)
+		}
+	}
+
+	return nil
+}
+
+// adminPayload returns the data signed by an admin. The subject is included so a signed request cannot be
+// sent to another endpoint.
+func adminPayload(subject, nonce string, data []byte) []byte {
+	return append([]byte(fmt.Sprintf("%s\n%s\n", subject, nonce)), data...)
+}
+
+// SignAdminRequest signs the request with an admin key. The nonce is the current time in nanoseconds, the
+// service rejects nonces that are too old or not newer than the last one it accepted for the key.
+func SignAdminRequest(kp nkeys.KeyPair, req *Request) error {
+	public, err := kp.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	nonce := strconv.FormatInt(time.Now().UnixNano(), 10)
+	sig, err := kp.Sign(adminPayload(req.Subject, nonce, req.Data))
+	if err != nil {
+		return err
+	}
+
+	if req.Header == nil {
+		req.Header = nats.Header{}
+	}
+	req.Header.Set(AdminKeyHeader, public)
+	req.Header.Set(AdminNonceHeader, nonce)
+	req.Header.Set(AdminSignatureHeader, base64.RawURLEncoding.EncodeToString(sig))
+
+	return nil
+}
+
+// verifyAdmin checks the admin signature on the request. It returns false if the request is not signed and a
+// 401 if the signature, key or nonce is not valid.
+func (a *AppContext) verifyAdmin(r micro.Request) (bool, error) {
+	public := r.Headers().Get(AdminKeyHeader)
+	if public == "" {
+		return false, nil
+	}
+
+	if !slices.Contains(a.AdminKeys, public) {
+		a.logger.Errorf("request signed by unknown admin key %s from %s", public, callerIdentity(r))
+		return false, NewClientError(fmt.Errorf("unknown admin key"), 401)
+	}
+
+	kp, err := nkeys.FromPublicKey(public)
+	if err != nil {
+		return false, NewClientError(fmt.Errorf("unknown admin key"), 401)
+	}
+
+	nonce := r.Headers().Get(AdminNonceHeader)
+	sig, err := base64.RawURLEncoding.DecodeString(r.Headers().Get(AdminSignatureHeader))
+	if err != nil || kp.Verify(adminPayload(r.Subject(), nonce, r.Data()), sig) != nil {
+		a.logger.Errorf("invalid signature for admin key %s from %s", public, callerIdentity(r))
+		return false, NewClientError(fmt.Errorf("invalid admin signature"), 401)
+	}
+
+	nanos, err := strconv.ParseInt(nonce, 10, 64)
+	if err != nil {
+		return false, NewClientError(fmt.Errorf("invalid admin nonce"), 401)
+	}
+
+	if age := time.Since(time.Unix(0, nanos)); age > adminNonceWindow || age < -adminNonceWindow {
+		return false, NewClientError(fmt.Errorf("admin nonce expired"), 401)
+	}
+
+	if err := a.useNonce(public, nanos); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// useNonce stores the nonce as the last one used by the admin key. Nonces must increase so a signed request
+// cannot be replayed to any instance.
+func (a *AppContext) useNonce(public string, nonce int64) error {
+	key := adminKeyPrefix + public
+	value := []byte(strconv.FormatInt(nonce, 10))
+
+	for i := 0; i < attemptsRetries; i++ {
+		entry, err := a.KV.Get(key)
+		if err == nats.ErrKeyNotFound {
+			_, err = a.KV.Create(key, value)
+		} else if err == nil {
+			last, _ := strconv.ParseInt(string(entry.Value()), 10, 64)
+			if nonce <= last {
+				return NewClientError(fmt.Errorf("admin nonce already used"), 401)
+			}
+			_, err = a.KV.Update(key, value, entry.Revision())
+		}
+
+		if isRevisionConflict(err) {
+			continue
+		}
+
+		return err
+	}
+
+	return NewClientError(fmt.Errorf("admin nonce already used"), 401)
+}
+
+// verifyAuthority checks that the request is signed by an admin key or carries the current unseal material.
+// Requests proving authority with the material are subject to the same backoff as unlock.
+func (a *AppContext) verifyAuthority(r micro.Request) error {
+	signed, err := a.verifyAdmin(r)
+	if err != nil || signed {
+		return err
+	}
+
+	claim, err := a.claimAttempt(attemptCaller(r))
+	if err != nil {
+		return err
+	}
+
+	if err := a.verifyMaterial(r.Data()); err != nil {
+		if isAuthFailure(err) {
+			a.recordFailure(attemptCaller(r), callerIdentity(r), err)
+		} else {
+			a.releaseAttempt(attemptCaller(r), claim)
+		}
+		return err
+	}
+	a.resetAttempts(attemptCaller(r))
+
+	return nil
+}
+
+// verifyMaterial checks the unseal material in a lock request against the init record
+func (a *AppContext) verifyMaterial(data []byte) error {
+	var req RotateRequest
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &req); err != nil {
+			return NewClientError(fmt.Errorf("bad request"), 400)
+		}
+	}
+
+	if req.CurrentKey == "" && len(req.CurrentShares) == 0 && req.Passphrase == "" {
+		return NewClientError(fmt.Errorf("admin signature or unseal material required"), 401)
+	}
+
+	record, err := a.getInitRecord()
+	if err == nats.ErrKeyNotFound {
+		return NewClientError(fmt.Errorf("database not initialized"), 400)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	key, kek, err := record.resolveKey(req.CurrentKey, req.CurrentShares, req.Passphrase)
+	if err != nil {
+		return err
+	}
+	defer zero(key)
+	defer zero(kek)
+
+	return record.open(key)
+}
@@ -0,0 +1,171 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func TestAdminLock(t *testing.T) {
+	admin, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := admin.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app, nc := newTestService(t, func(a *AppContext) { a.AdminKeys = []string{public} })
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock := SubjectVerbs[DBLock]
+	if code := requestCode(t, nc, lock, nil); code != "401" {
+		t.Errorf("expected unauthenticated lock to be rejected with 401 but got %s", code)
+	}
+
+	// a failed attempt delays the next lock with unseal material
+	time.Sleep(lockoutBaseDelay)
+
+	data, err := json.Marshal(RotateRequest{CurrentKey: toBase64(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := requestCode(t, nc, lock, data); code != "200" {
+		t.Errorf("expected lock with the database key to succeed but got %s", code)
+	}
+
+	req := Request{Subject: lock}
+	if err := SignAdminRequest(admin, &req); err != nil {
+		t.Fatal(err)
+	}
+	msg := &nats.Msg{Subject: req.Subject, Header: req.Header}
+
+	signed, err := nc.RequestMsg(msg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := signed.Header.Get("Nats-Service-Error-Code"); code != "" {
+		t.Errorf("expected signed lock to succeed but got %s", code)
+	}
+
+	replayed, err := nc.RequestMsg(msg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := replayed.Header.Get("Nats-Service-Error-Code"); code != "401" {
+		t.Errorf("expected replayed lock to be rejected with 401 but got %s", code)
+	}
+
+	other, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client{Conn: nc, AdminKey: other}
+	if _, err := client.Do(Request{Subject: lock}); err == nil {
+		t.Error("expected lock signed by an unknown key to fail")
+	}
+
+	client.AdminKey = admin
+	if _, err := client.Do(Request{Subject: lock}); err != nil {
+		t.Errorf("expected client signed lock to succeed: %v", err)
+	}
+}
+
+func TestAdminInitialize(t *testing.T) {
+	admin, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := admin.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, nc := newTestService(t, func(a *AppContext) { a.AdminKeys = []string{public} })
+	if code := requestCode(t, nc, SubjectVerbs[DBInit], nil); code != "401" {
+		t.Fatalf("expected unsigned init to be rejected with 401 but got %s", code)
+	}
+
+	client := Client{Conn: nc, AdminKey: admin}
+	request, err := NewInitRequest(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Do(request); err != nil {
+		t.Errorf("expected signed init to succeed: %v", err)
+	}
+}
+
+func TestAdminMigrate(t *testing.T) {
+	admin, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := admin.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app, nc := newTestService(t, func(a *AppContext) { a.AdminKeys = []string{public} })
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	migrate := SubjectVerbs[DBMigrate]
+	if code := requestCode(t, nc, migrate, nil); code != "401" {
+		t.Errorf("expected unauthenticated migrate to be rejected with 401 but got %s", code)
+	}
+
+	// a failed attempt delays the next migrate with unseal material
+	time.Sleep(lockoutBaseDelay)
+
+	request, err := NewMigrateRequest(MigrateRequest{RotateRequest: RotateRequest{CurrentKey: toBase64(key)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := requestCode(t, nc, migrate, request.Data); code != "200" {
+		t.Errorf("expected migrate with the database key to succeed but got %s", code)
+	}
+	app.rotation.wait()
+
+	request, err = NewMigrateRequest(MigrateRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client{Conn: nc, AdminKey: admin}
+	if _, err := client.Do(request); err != nil {
+		t.Errorf("expected signed migrate to succeed: %v", err)
+	}
+	app.rotation.wait()
+}
+
+func TestValidateAdminKeys(t *testing.T) {
+	user, err := nkeys.CreateUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := user.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ValidateAdminKeys([]string{public}); err != nil {
+		t.Error(err)
+	}
+
+	if err := ValidateAdminKeys([]string{"not a key"}); err == nil {
+		t.Error("expected invalid key to be rejected")
+	}
+}
@@ -0,0 +1,152 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/CoverWhale/logr"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	autoLockEvent       = "autolock"
+	autoLockInterval    = time.Second
+	AutoLockIdle        = "idle"
+	AutoLockMaxUnlocked = "max_unlocked"
+	AutoLockDisconnect  = "disconnect"
+)
+
+// AutoLockPolicy controls when an instance locks the database on its own. Idle locks the database when no
+// secret has been read for that long on any instance, MaxUnlocked locks it once it has been unlocked for that
+// long no matter how it is used, and OnDisconnect locks the instance when it loses its NATS connection. A zero
+// duration disables that policy.
+type AutoLockPolicy struct {
+	Idle         time.Duration
+	MaxUnlocked  time.Duration
+	OnDisconnect bool
+}
+
+// AutoLockEvent describes an auto-lock. It is published to piggybank.events.autolock and included in the status
+// until the database is unlocked again.
+type AutoLockEvent struct {
+	Instance string    `json:"instance"`
+	Reason   string    `json:"reason"`
+	Details  string    `json:"details"`
+	Time     time.Time `json:"time"`
+}
+
+// Validate checks the policy durations
+func (p AutoLockPolicy) Validate() error {
+	if p.Idle < 0 || p.MaxUnlocked < 0 {
+		return fmt.Errorf("auto-lock durations cannot be negative")
+	}
+
+	return nil
+}
+
+// StartAutoLock enforces the auto-lock policy until the returned stop function is called. Idle and maximum
+// unlocked times are checked every second. An idle or expired instance locks every instance, a disconnected
+// instance only locks itself since the others can still be reached.
+func (a *AppContext) StartAutoLock(logger *logr.Logger, policy AutoLockPolicy) (func(), error) {
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+
+	app := *a
+	app.logger = logger.WithContext(map[string]string{"instance": a.member.id})
+
+	if policy.OnDisconnect {
+		if a.Conn == nil {
+			return nil, fmt.Errorf("a NATS connection is required to lock on disconnect")
+		}
+
+		previous := a.Conn.Opts.DisconnectedErrCB
+		a.Conn.SetDisconnectErrHandler(func(nc *nats.Conn, err error) {
+			if previous != nil {
+				previous(nc, err)
+			}
+			// the service seals the database itself when it shuts down
+			if nc.IsClosed() {
+				return
+			}
+			app.autoLock(AutoLockDisconnect, "disconnected from NATS", false)
+		})
+	}
+
+	done := make(chan struct{})
+	if policy.Idle > 0 || policy.MaxUnlocked > 0 {
+		go func() {
+			ticker := time.NewTicker(autoLockInterval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case now := <-ticker.C:
+					app.checkAutoLock(policy, now)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	return func() { close(done) }, nil
+}
+
+// checkAutoLock locks the database if it has been unlocked for longer than the maximum or if no secret
+// has been read on any instance for the idle time
+func (a *AppContext) checkAutoLock(policy AutoLockPolicy, now time.Time) {
+	unlockedAt, lastRead := a.keys.activity()
+	if unlockedAt.IsZero() {
+		return
+	}
+
+	if policy.MaxUnlocked > 0 && now.Sub(unlockedAt) >= policy.MaxUnlocked {
+		a.autoLock(AutoLockMaxUnlocked, fmt.Sprintf("unlocked for longer than %s", policy.MaxUnlocked), true)
+		return
+	}
+
+	if policy.Idle == 0 || now.Sub(lastRead) < policy.Idle {
+		return
+	}
+
+	// reads are load balanced, so the database is only idle if no instance has served a read
+	for _, peer := range a.peers() {
+		if peer.LastRead != nil && now.Sub(*peer.LastRead) < policy.Idle {
+			return
+		}
+	}
+
+	a.autoLock(AutoLockIdle, fmt.Sprintf("no secrets read for %s", policy.Idle), true)
+}
+
+// autoLock locks this instance, records the reason for the status and publishes an autolock event. If broadcast
+// is set every other instance is locked too.
+func (a *AppContext) autoLock(reason, details string, broadcast bool) {
+	if !a.keys.unlocked() {
+		return
+	}
+
+	event := AutoLockEvent{
+		Instance: a.member.id,
+		Reason:   reason,
+		Details:  details,
+		Time:     time.Now(),
+	}
+
+	a.sealWith(&event)
+	a.logger.Infof("database auto locked, %s", details)
+
+	if broadcast {
+		a.broadcastLock(&event)
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		a.logger.Errorf("error encoding autolock event: %v", err)
+		return
+	}
+
+	a.publishEvent(autoLockEvent, data)
+}
@@ -0,0 +1,144 @@
+package service
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/CoverWhale/logr"
+	"github.com/nats-io/nats.go"
+)
+
+func TestAutoLockMaxUnlocked(t *testing.T) {
+	server := NewServer(t)
+	defer shutdownJSServerAndRemoveStorage(t, server)
+
+	_, app := setupEncryptedVals(t, server, testVals)
+	policy := AutoLockPolicy{MaxUnlocked: time.Hour}
+
+	unlockedAt, _ := app.keys.activity()
+	app.checkAutoLock(policy, unlockedAt.Add(time.Minute))
+	if !app.keys.unlocked() {
+		t.Fatal("expected database to stay unlocked before the maximum unlocked time")
+	}
+
+	// reads do not extend the maximum unlocked time
+	if _, err := app.getRecord(&JetStreamRecord{bucket: piggyBucket, key: "piggybank.secrets.secret1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	app.checkAutoLock(policy, unlockedAt.Add(time.Hour))
+	if app.keys.unlocked() {
+		t.Fatal("expected database to be locked after the maximum unlocked time")
+	}
+
+	status, err := app.status(unidentifiedCaller)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.AutoLock == nil || status.AutoLock.Reason != AutoLockMaxUnlocked {
+		t.Errorf("expected status to report auto-lock reason %s but got %+v", AutoLockMaxUnlocked, status.AutoLock)
+	}
+}
+
+func TestAutoLockIdle(t *testing.T) {
+	apps := newTestCluster(t, 2)
+
+	key, err := apps[0].initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := unlockRequest(t, toBase64(key))
+	if _, err := apps[0].unlock(data); err != nil {
+		t.Fatal(err)
+	}
+	apps[0].forwardUnlock(data)
+	waitFor(t, apps[1].keys.unlocked)
+
+	events, err := apps[0].Conn.SubscribeSync(eventSubject + "." + autoLockEvent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := apps[1].addRecord(&JetStreamRecord{keys: apps[1].keys, bucket: piggyBucket, key: "piggybank.secrets.idle", value: []byte("value")}); err != nil {
+		t.Fatal(err)
+	}
+
+	policy := AutoLockPolicy{Idle: time.Minute}
+	longAgo := time.Now().Add(-time.Hour).UnixNano()
+
+	// a read on another instance keeps the database unlocked
+	apps[0].keys.lastRead.Store(longAgo)
+	if _, err := apps[1].getRecord(&JetStreamRecord{bucket: piggyBucket, key: "piggybank.secrets.idle"}); err != nil {
+		t.Fatal(err)
+	}
+
+	apps[0].checkAutoLock(policy, time.Now())
+	if !apps[0].keys.unlocked() {
+		t.Fatal("expected database to stay unlocked while another instance is serving reads")
+	}
+
+	apps[1].keys.lastRead.Store(longAgo)
+	apps[0].checkAutoLock(policy, time.Now())
+	if apps[0].keys.unlocked() {
+		t.Fatal("expected database to be locked when idle")
+	}
+	waitFor(t, func() bool { return !apps[1].keys.unlocked() })
+
+	if event := apps[1].keys.lastAutoLock(); event == nil || event.Reason != AutoLockIdle {
+		t.Errorf("expected peer to report auto-lock reason %s but got %+v", AutoLockIdle, event)
+	}
+
+	msg, err := events.NextMsg(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var event AutoLockEvent
+	if err := json.Unmarshal(msg.Data, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if event.Reason != AutoLockIdle || event.Instance != apps[0].member.id {
+		t.Errorf("unexpected autolock event %+v", event)
+	}
+}
+
+func TestAutoLockDisconnect(t *testing.T) {
+	server := NewServer(t)
+	defer shutdownJSServerAndRemoveStorage(t, server)
+
+	_, app := setupEncryptedVals(t, server, testVals)
+
+	nc, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	app.Conn = nc
+
+	stop, err := app.StartAutoLock(logr.NewLogger(), AutoLockPolicy{OnDisconnect: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+
+	server.Shutdown()
+	waitFor(t, func() bool { return !app.keys.unlocked() })
+
+	if event := app.keys.lastAutoLock(); event == nil || event.Reason != AutoLockDisconnect {
+		t.Errorf("expected auto-lock reason %s but got %+v", AutoLockDisconnect, event)
+	}
+}
+
+func TestAutoLockPolicyValidate(t *testing.T) {
+	if err := (AutoLockPolicy{Idle: -time.Second}).Validate(); err == nil {
+		t.Error("expected negative idle time to be rejected")
+	}
+
+	if err := (AutoLockPolicy{Idle: time.Minute, MaxUnlocked: time.Hour}).Validate(); err != nil {
+		t.Error(err)
+	}
+}
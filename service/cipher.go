@@ -0,0 +1,134 @@
+package service
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+const (
+	algAES256GCM         = "aes-256-gcm"
+	algXChaCha20Poly1305 = "xchacha20-poly1305"
+)
+
+// Cipher seals and opens data with a 32 byte key. The ID is stored with every envelope so secrets can be
+// opened with the cipher that sealed them.
+type Cipher interface {
+	ID() string
+	Seal(plaintext, key, additionalData []byte) ([]byte, error)
+	Open(ciphertext, key, additionalData []byte) ([]byte, error)
+}
+
+// ciphers holds every supported cipher by ID
+var ciphers = map[string]Cipher{
+	algAES256GCM:         aesGCM{},
+	algXChaCha20Poly1305: xChaCha20Poly1305{},
+}
+
+// getCipher returns the cipher for the ID. Envelopes written before the algorithm was recorded use AES-256-GCM.
+func getCipher(id string) (Cipher, error) {
+	if id == "" {
+		return aesGCM{}, nil
+	}
+
+	c, ok := ciphers[id]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %s", id)
+	}
+
+	return c, nil
+}
+
+// GetCipherIDs returns the IDs of the supported ciphers
+func GetCipherIDs() []string {
+	return []string{algAES256GCM, algXChaCha20Poly1305}
+}
+
+// seal encrypts the plaintext with the AEAD using a random nonce and prepends the nonce to the ciphertext
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	_, err := io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open splits the nonce from the ciphertext and decrypts it with the AEAD
+func open(aead cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("malformed ciphertext")
+	}
+
+	return aead.Open(nil,
+		ciphertext[:aead.NonceSize()],
+		ciphertext[aead.NonceSize():],
+		additionalData,
+	)
+}
+
+// aesGCM is AES-256 in GCM mode with random 96 bit nonces
+type aesGCM struct{}
+
+func (aesGCM) ID() string {
+	return algAES256GCM
+}
+
+func (aesGCM) aead(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (a aesGCM) Seal(plaintext, key, additionalData []byte) ([]byte, error) {
+	aead, err := a.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return seal(aead, plaintext, additionalData)
+}
+
+func (a aesGCM) Open(ciphertext, key, additionalData []byte) ([]byte, error) {
+	aead, err := a.aead(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(aead, ciphertext, additionalData)
+}
+
+// xChaCha20Poly1305 is XChaCha20-Poly1305 with random 192 bit nonces, which are large enough
+// that nonce collisions are not a concern no matter how many times a bucket is rewritten.
+type xChaCha20Poly1305 struct{}
+
+func (xChaCha20Poly1305) ID() string {
+	return algXChaCha20Poly1305
+}
+
+func (xChaCha20Poly1305) Seal(plaintext, key, additionalData []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return seal(aead, plaintext, additionalData)
+}
+
+func (xChaCha20Poly1305) Open(ciphertext, key, additionalData []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return open(aead, ciphertext, additionalData)
+}
@@ -0,0 +1,80 @@
+package service
+
+import (
+	"testing"
+)
+
+func TestCiphers(t *testing.T) {
+	for _, id := range GetCipherIDs() {
+		t.Run(id, func(t *testing.T) {
+			c, err := getCipher(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			key := generateKey()
+			secret := []byte("piggybank rules")
+
+			sealed, err := c.Seal(secret, key, []byte("aad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			opened, err := c.Open(sealed, key, []byte("aad"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(opened) != string(secret) {
+				t.Errorf("expected %s, but got %s", secret, opened)
+			}
+
+			if _, err := c.Open(sealed, key, []byte("other")); err == nil {
+				t.Error("expected open with different additional data to fail")
+			}
+
+			if _, err := c.Open(sealed, generateKey(), []byte("aad")); err == nil {
+				t.Error("expected open with different key to fail")
+			}
+		})
+	}
+}
+
+func TestUnknownCipher(t *testing.T) {
+	if _, err := getCipher("rot13"); err == nil {
+		t.Error("expected error for unknown cipher")
+	}
+
+	if err := (InitRequest{Algorithm: "rot13"}).Validate(); err == nil {
+		t.Error("expected init request with unknown cipher to be invalid")
+	}
+}
+
+func TestRewrapBetweenCiphers(t *testing.T) {
+	key := generateKey()
+	secret := []byte("switch ciphers")
+
+	sealed, err := sealEnvelope(aesGCM{}, "app.secret", secret, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switched, err := rewrapEnvelope(xChaCha20Poly1305{}, "app.secret", sealed, key, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, ok := parseEnvelope(switched)
+	if !ok || !env.current(xChaCha20Poly1305{}, key) {
+		t.Fatalf("expected envelope to be sealed with %s", algXChaCha20Poly1305)
+	}
+
+	opened, err := openEnvelope("app.secret", switched, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(opened) != string(secret) {
+		t.Errorf("expected %s, but got %s", secret, opened)
+	}
+}
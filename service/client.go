@@ -3,13 +3,45 @@ package service
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+// Client sends requests to the service. If AdminKey is set requests to the administrative endpoints are signed with it.
+// If ServiceKey is set every response must be signed by that service public key.
+const (
+	DefaultClientTimeout = time.Second
+	// unsealClientTimeout is the default for requests that may derive a key from a passphrase or check unseal
+	// material, which runs scrypt and can take longer than other requests
+	unsealClientTimeout = 30 * time.Second
 )
 
 type Client struct {
-	Conn *nats.Conn
+	Conn       *nats.Conn
+	AdminKey   nkeys.KeyPair
+	ServiceKey string
+	// Timeout is how long to wait for a response. When it is 0 requests that may derive a key from a passphrase
+	// wait 30 seconds and every other request waits DefaultClientTimeout.
+	Timeout time.Duration
+}
+
+// timeout returns how long to wait for a response to a request sent to the subject
+func (c *Client) timeout(subject string) time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+
+	for _, v := range []DBVerb{DBInit, DBUnlock, DBLock, DBRotate, DBRekey, DBMigrate} {
+		if subject == SubjectVerbs[v] {
+			return unsealClientTimeout
+		}
+	}
+
+	return DefaultClientTimeout
 }
 
 type DbRequest struct {
@@ -20,6 +52,7 @@ type DbRequest struct {
 type Request struct {
 	Subject string
 	Data    []byte
+	Header  nats.Header
 }
 
 type ResponseError struct {
@@ -32,7 +65,36 @@ func NewDBRequest(verb DBVerb, key string) (Request, error) {
 		return Request{}, fmt.Errorf("invalid verb")
 	}
 
-	data, err := json.Marshal(DatabaseKey{DBKey: key})
+	var body any = DatabaseKey{DBKey: key}
+	if verb == DBRotate {
+		body = RotateRequest{CurrentKey: key}
+	}
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return Request{}, err
+	}
+
+	return Request{
+		Subject: subject,
+		Data:    data,
+	}, nil
+}
+
+// NewPassphraseRequest returns an unlock or rotate request that proves the caller holds the database key
+// with the passphrase protecting it
+func NewPassphraseRequest(verb DBVerb, passphrase string) (Request, error) {
+	subject, ok := SubjectVerbs[verb]
+	if !ok {
+		return Request{}, fmt.Errorf("invalid verb")
+	}
+
+	var body any = DatabaseKey{Passphrase: passphrase}
+	if verb == DBRotate {
+		body = RotateRequest{Passphrase: passphrase}
+	}
+
+	data, err := json.Marshal(body)
 	if err != nil {
 		return Request{}, err
 	}
@@ -43,6 +105,75 @@ func NewDBRequest(verb DBVerb, key string) (Request, error) {
 	}, nil
 }
 
+// NewRotateRequest returns a request that replaces the database key. The caller proves they hold the current
+// key with the key itself, its shares or the passphrase protecting it.
+func NewRotateRequest(req RotateRequest) (Request, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return Request{}, err
+	}
+
+	return Request{
+		Subject: SubjectVerbs[DBRotate],
+		Data:    data,
+	}, nil
+}
+
+// NewLockRequest returns a lock request that proves the caller holds the unseal material. It is not needed
+// when the client signs requests with an admin key.
+func NewLockRequest(req RotateRequest) (Request, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return Request{}, err
+	}
+
+	return Request{
+		Subject: SubjectVerbs[DBLock],
+		Data:    data,
+	}, nil
+}
+
+// NewRekeyRequest returns a request that replaces the unseal material with the configuration in req.New
+func NewRekeyRequest(req RekeyRequest) (Request, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return Request{}, err
+	}
+
+	return Request{
+		Subject: SubjectVerbs[DBRekey],
+		Data:    data,
+	}, nil
+}
+
+// NewInitRequest returns a request to initialize the database with the passed in options
+func NewInitRequest(opts InitRequest) (Request, error) {
+	data, err := json.Marshal(opts)
+	if err != nil {
+		return Request{}, err
+	}
+
+	return Request{
+		Subject: SubjectVerbs[DBInit],
+		Data:    data,
+	}, nil
+}
+
+// NewMigrateRequest returns a request to migrate secrets to the latest format. If the algorithm is set
+// the secrets are sealed again with that cipher. The unseal material is not needed when the client signs
+// requests with an admin key.
+func NewMigrateRequest(req MigrateRequest) (Request, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return Request{}, err
+	}
+
+	return Request{
+		Subject: SubjectVerbs[DBMigrate],
+		Data:    data,
+	}, nil
+}
+
 func NewRequest(verb Verb, key string) (Request, error) {
 	subject := fmt.Sprintf("%s.%s", verb, key)
 	return Request{
@@ -61,29 +192,346 @@ func (c *Client) Post(key string, data []byte) (string, error) {
 	return c.Do(Request{Subject: subject, Data: data})
 }
 
+// GetRevision returns the secret along with its current revision, which can be passed to PostRevision
+func (c *Client) GetRevision(key string) (string, uint64, error) {
+	subject := fmt.Sprintf("%s.%s.%s", secretSubject, GET, key)
+	resp, err := c.DoResponse(Request{Subject: subject, Data: nil})
+	if err != nil {
+		return "", 0, err
+	}
+
+	return resp.Details, resp.Revision, nil
+}
+
+// PostRevision stores the secret only if it is currently at the expected revision. A revision of 0
+// stores the secret only if it does not exist. The new revision is returned.
+func (c *Client) PostRevision(key string, data []byte, revision uint64) (uint64, error) {
+	header := nats.Header{}
+	header.Set(ExpectedRevisionHeader, strconv.FormatUint(revision, 10))
+
+	return c.post(key, data, header)
+}
+
+// PostTTL stores the secret so that it expires after the ttl. The new revision is returned.
+func (c *Client) PostTTL(key string, data []byte, ttl time.Duration) (uint64, error) {
+	header := nats.Header{}
+	header.Set(TTLHeader, ttl.String())
+
+	return c.post(key, data, header)
+}
+
+// PostExpires stores the secret so that it expires at the passed in time. The new revision is returned.
+func (c *Client) PostExpires(key string, data []byte, expires time.Time) (uint64, error) {
+	header := nats.Header{}
+	header.Set(ExpiresHeader, expires.Format(time.RFC3339))
+
+	return c.post(key, data, header)
+}
+
+func (c *Client) post(key string, data []byte, header nats.Header) (uint64, error) {
+	subject := fmt.Sprintf("%s.%s.%s", secretSubject, POST, key)
+	resp, err := c.DoResponse(Request{Subject: subject, Data: data, Header: header})
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.Revision, nil
+}
+
+// GetJSON unmarshals a secret holding a JSON object into v
+func (c *Client) GetJSON(key string, v any) error {
+	value, err := c.Get(key)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal([]byte(value), v)
+}
+
+// PostJSON stores v as a secret holding a JSON object and returns the new revision
+func (c *Client) PostJSON(key string, v any) (uint64, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.post(key, data, nil)
+}
+
+// GetField returns a single field of a secret holding a JSON object. String fields are returned unquoted and
+// other values as JSON.
+func (c *Client) GetField(key, field string) (string, error) {
+	subject := fmt.Sprintf("%s.%s.%s", secretSubject, GET, key)
+	header := nats.Header{}
+	header.Set(FieldHeader, field)
+
+	return c.Do(Request{Subject: subject, Header: header})
+}
+
+// PostField sets a single field of a secret holding a JSON object to the value as a string, leaving the other
+// fields as they are, and returns the new revision
+func (c *Client) PostField(key, field string, value []byte) (uint64, error) {
+	header := nats.Header{}
+	header.Set(FieldHeader, field)
+
+	return c.post(key, value, header)
+}
+
+// DeleteField removes a single field from a secret holding a JSON object and returns the new revision
+func (c *Client) DeleteField(key, field string) (uint64, error) {
+	subject := fmt.Sprintf("%s.%s.%s", secretSubject, DELETE, key)
+	header := nats.Header{}
+	header.Set(FieldHeader, field)
+
+	resp, err := c.DoResponse(Request{Subject: subject, Header: header})
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.Revision, nil
+}
+
+// GetAt returns the secret as it was at the revision
+func (c *Client) GetAt(key string, revision uint64) (string, error) {
+	subject := fmt.Sprintf("%s.%s.%s", secretSubject, GET, key)
+	header := nats.Header{}
+	header.Set(RevisionHeader, strconv.FormatUint(revision, 10))
+
+	return c.Do(Request{Subject: subject, Header: header})
+}
+
+// History returns the versions of the secret the bucket still holds, oldest first
+func (c *Client) History(key string) ([]SecretVersion, error) {
+	subject := fmt.Sprintf("%s.%s.%s", secretSubject, HISTORY, key)
+	resp, err := c.DoResponse(Request{Subject: subject, Data: nil})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.History, nil
+}
+
+// Rollback stores the value the secret had at the revision as a new revision, which is returned
+func (c *Client) Rollback(key string, revision uint64) (uint64, error) {
+	subject := fmt.Sprintf("%s.%s.%s", secretSubject, ROLLBACK, key)
+	header := nats.Header{}
+	header.Set(RevisionHeader, strconv.FormatUint(revision, 10))
+
+	resp, err := c.DoResponse(Request{Subject: subject, Header: header})
+	if err != nil {
+		return 0, err
+	}
+
+	return resp.Revision, nil
+}
+
+// Metadata returns the metadata of the secret
+func (c *Client) Metadata(key string) (SecretMetadata, error) {
+	return c.metadata(key, nil)
+}
+
+// UpdateMetadata sets the client fields of the secret's metadata and returns the result
+func (c *Client) UpdateMetadata(key string, update MetadataUpdate) (SecretMetadata, error) {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return SecretMetadata{}, err
+	}
+
+	return c.metadata(key, data)
+}
+
+func (c *Client) metadata(key string, data []byte) (SecretMetadata, error) {
+	subject := fmt.Sprintf("%s.%s.%s", secretSubject, META, key)
+	resp, err := c.DoResponse(Request{Subject: subject, Data: data})
+	if err != nil {
+		return SecretMetadata{}, err
+	}
+
+	if resp.Metadata == nil {
+		return SecretMetadata{}, fmt.Errorf("response has no metadata")
+	}
+
+	return *resp.Metadata, nil
+}
+
+// List returns a page of the secrets under the prefix, every secret if the prefix is empty, and the key to
+// pass as After in req for the next page. The key is empty on the last page.
+func (c *Client) List(prefix string, req ListRequest) ([]SecretListing, string, error) {
+	subject := fmt.Sprintf("%s.%s", secretSubject, LIST)
+	if prefix != "" {
+		subject = fmt.Sprintf("%s.%s", subject, prefix)
+	}
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return nil, "", err
+	}
+
+	resp, err := c.DoResponse(Request{Subject: subject, Data: data})
+	if err != nil {
+		return nil, "", err
+	}
+
+	return resp.Secrets, resp.Next, nil
+}
+
 func (c *Client) Delete(key string) (string, error) {
 	subject := fmt.Sprintf("%s.%s.%s", secretSubject, DELETE, key)
 	return c.Do(Request{Subject: subject, Data: nil})
 }
 
+// transitRequest returns the subject for a transit operation on the named key
+func transitRequest(verb Verb, name string, data []byte) Request {
+	return Request{Subject: fmt.Sprintf("%s.%s.%s", transitSubject, verb, name), Data: data}
+}
+
+// CreateTransitKey creates a named transit key
+func (c *Client) CreateTransitKey(name string) error {
+	_, err := c.Do(transitRequest(TransitCreate, name, nil))
+	return err
+}
+
+// RotateTransitKey adds a new version to the transit key, values are produced by the new version from then on
+func (c *Client) RotateTransitKey(name string) error {
+	_, err := c.Do(transitRequest(TransitRotate, name, nil))
+	return err
+}
+
+// TransitEncrypt encrypts the plaintext with the transit key and returns the ciphertext. Nothing is stored.
+func (c *Client) TransitEncrypt(name string, plaintext []byte) (string, error) {
+	return c.Do(transitRequest(TransitEncrypt, name, plaintext))
+}
+
+// TransitDecrypt decrypts a ciphertext returned by TransitEncrypt or TransitRewrap
+func (c *Client) TransitDecrypt(name, ciphertext string) ([]byte, error) {
+	plaintext, err := c.Do(transitRequest(TransitDecrypt, name, []byte(ciphertext)))
+	if err != nil {
+		return nil, err
+	}
+
+	return fromBase64(plaintext)
+}
+
+// TransitRewrap encrypts the ciphertext again with the latest version of the transit key
+func (c *Client) TransitRewrap(name, ciphertext string) (string, error) {
+	return c.Do(transitRequest(TransitRewrap, name, []byte(ciphertext)))
+}
+
+// TransitHMAC returns an HMAC-SHA256 of the input made with the transit key
+func (c *Client) TransitHMAC(name string, input []byte) (string, error) {
+	return c.Do(transitRequest(TransitHMAC, name, input))
+}
+
+// TransitSign returns an Ed25519 signature of the input made with the transit key
+func (c *Client) TransitSign(name string, input []byte) (string, error) {
+	return c.Do(transitRequest(TransitSign, name, input))
+}
+
+// TransitVerify checks a signature returned by TransitSign
+func (c *Client) TransitVerify(name string, input []byte, signature string) (bool, error) {
+	return c.transitVerify(name, TransitVerifyRequest{Input: input, Signature: signature})
+}
+
+// TransitVerifyHMAC checks an HMAC returned by TransitHMAC
+func (c *Client) TransitVerifyHMAC(name string, input []byte, mac string) (bool, error) {
+	return c.transitVerify(name, TransitVerifyRequest{Input: input, HMAC: mac})
+}
+
+func (c *Client) transitVerify(name string, req TransitVerifyRequest) (bool, error) {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.DoResponse(transitRequest(TransitVerify, name, data))
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Valid, nil
+}
+
 func (c *Client) Do(request Request) (string, error) {
-	msg, err := c.Conn.Request(request.Subject, request.Data, 1*time.Second)
+	resp, err := c.DoResponse(request)
 	if err != nil {
 		return "", err
 	}
+
+	return resp.Details, nil
+}
+
+// DoResponse sends the request and returns the full response message. Responses carrying secrets are sealed
+// to a curve key created for the request so they cannot be read by other subscribers of the reply inbox.
+func (c *Client) DoResponse(request Request) (ResponseMessage, error) {
+	header := nats.Header{}
+	for k, v := range request.Header {
+		header[k] = v
+	}
+	request.Header = header
+
+	if c.AdminKey != nil && slices.Contains(adminSubjects, request.Subject) {
+		if err := SignAdminRequest(c.AdminKey, &request); err != nil {
+			return ResponseMessage{}, err
+		}
+	}
+
+	var nonce string
+	if c.ServiceKey != "" {
+		var err error
+		nonce, err = newResponseNonce()
+		if err != nil {
+			return ResponseMessage{}, err
+		}
+		header.Set(ResponseNonceHeader, nonce)
+	}
+
+	var recipient nkeys.KeyPair
+	if sealedSubject(request.Subject) {
+		var err error
+		recipient, err = nkeys.CreateCurveKeys()
+		if err != nil {
+			return ResponseMessage{}, err
+		}
+		defer recipient.Wipe()
+
+		public, err := recipient.PublicKey()
+		if err != nil {
+			return ResponseMessage{}, err
+		}
+		header.Set(RecipientKeyHeader, public)
+	}
+
+	msg, err := c.Conn.RequestMsg(&nats.Msg{Subject: request.Subject, Data: request.Data, Header: request.Header}, c.timeout(request.Subject))
+	if err != nil {
+		return ResponseMessage{}, err
+	}
+
+	if c.ServiceKey != "" {
+		if err := verifyResponse(c.ServiceKey, request.Subject, nonce, msg); err != nil {
+			return ResponseMessage{}, err
+		}
+	}
 	code := msg.Header.Get("Nats-Service-Error-Code")
 	if code != "" {
 		var respErr ResponseError
 		if err := json.Unmarshal(msg.Data, &respErr); err != nil {
-			return "", err
+			return ResponseMessage{}, err
+		}
+		return ResponseMessage{}, fmt.Errorf("status %s, details %v", code, respErr.Error)
+	}
+
+	data := msg.Data
+	if recipient != nil {
+		data, err = openResponse(recipient, msg)
+		if err != nil {
+			return ResponseMessage{}, err
 		}
-		return "", fmt.Errorf("status %s, details %v", code, respErr.Error)
 	}
 
 	var resp ResponseMessage
-	if err := json.Unmarshal(msg.Data, &resp); err != nil {
-		return "", err
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return ResponseMessage{}, err
 	}
 
-	return resp.Details, nil
+	return resp, nil
 }
@@ -0,0 +1,494 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CoverWhale/logr"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/segmentio/ksuid"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const (
+	clusterSubject       = "piggybank.database.cluster"
+	clusterStatusSubject = "status"
+	clusterLockSubject   = "lock"
+	clusterTimeout       = 250 * time.Millisecond
+	clusterWindow        = 30 * time.Second
+	clusterUnlock        = "unlock"
+	clusterReload        = "reload"
+	InstanceHeader       = "Piggybank-Instance"
+	ClusterTimeHeader    = "Piggybank-Cluster-Time"
+)
+
+// InstanceStatus is the seal state of a single service instance. The public key is used by the other
+// instances to seal the messages they forward to it, and the time a secret was last read is used to check
+// if the database is idle.
+type InstanceStatus struct {
+	ID         string     `json:"id"`
+	Locked     bool       `json:"locked"`
+	Progress   int        `json:"progress,omitempty"`
+	KeyID      string     `json:"key_id,omitempty"`
+	LastRead   *time.Time `json:"last_read,omitempty"`
+	AutoLocked string     `json:"auto_locked,omitempty"`
+	PublicKey  []byte     `json:"public_key,omitempty"`
+}
+
+// clusterMessage is forwarded to another instance sealed to its public key. Unlock messages hold the unlock
+// request sent by the client so every instance accumulates the same shares. Reload messages tell an unlocked
+// instance the init record changed after a rotation or migration, the database key itself is never sent.
+type clusterMessage struct {
+	Kind string `json:"kind"`
+	Data []byte `json:"data"`
+}
+
+// clusterMember identifies this instance to the other instances of the service. The key pair is generated
+// when the instance joins the cluster and never leaves the process. The time of the last message accepted from
+// each instance is kept so a signed message cannot be replayed.
+type clusterMember struct {
+	id         string
+	publicKey  *[32]byte
+	privateKey *[32]byte
+	mu         sync.Mutex
+	last       map[string]int64
+}
+
+func newClusterMember() *clusterMember {
+	return &clusterMember{id: ksuid.New().String(), last: map[string]int64{}}
+}
+
+// joined returns true if the instance is listening for other instances
+func (c *clusterMember) joined() bool {
+	return c != nil && c.publicKey != nil
+}
+
+// accept records the time a message from the instance was sent on the subject. It returns false if a message sent
+// on the subject at the same time or later was already accepted. Subjects are tracked separately since each is
+// handled on its own.
+func (c *clusterMember) accept(subject, instance string, sent int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	k := fmt.Sprintf("%s %s", subject, instance)
+	if sent <= c.last[k] {
+		return false
+	}
+	c.last[k] = sent
+
+	return true
+}
+
+// JoinCluster subscribes to the subjects used to share the seal state between every instance of the service.
+// The database endpoints are load balanced across instances, so an unlock or lock only reaches one of them.
+// That instance forwards the change to the others. It must be called once before the service starts handling requests.
+//
+// Every cluster message is signed with the cluster key, which every instance holds, and messages that are not
+// signed by it are dropped. An instance without a cluster key cannot share its seal state, so joining fails.
+// A single instance can run without one after checking with CheckStandalone.
+func (a *AppContext) JoinCluster(logger *logr.Logger) error {
+	if a.Conn == nil {
+		return fmt.Errorf("a NATS connection is required to join the cluster")
+	}
+
+	if a.ClusterKey == nil {
+		return fmt.Errorf("a cluster key is required to share the seal state with other instances")
+	}
+
+	if err := ValidateSigner(a.ClusterKey); err != nil {
+		return fmt.Errorf("invalid cluster key: %v", err)
+	}
+
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	a.member.publicKey, a.member.privateKey = publicKey, privateKey
+
+	app := *a
+	app.logger = logger.WithContext(map[string]string{"instance": a.member.id})
+
+	handlers := map[string]nats.MsgHandler{
+		clusterStatusSubject: app.handleClusterStatus,
+		clusterLockSubject:   app.handleClusterLock,
+		a.member.id:          app.handleClusterMessage,
+	}
+
+	for subject, handler := range handlers {
+		if _, err := a.Conn.Subscribe(fmt.Sprintf("%s.%s", clusterSubject, subject), handler); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CheckStandalone returns an error if another instance of the service with the name is running. Instances without
+// a cluster key cannot share their seal state, so only one of them may serve the bank. It must be called before
+// the service is added so the instance does not find itself.
+func (a *AppContext) CheckStandalone(name string) error {
+	if a.Conn == nil {
+		return fmt.Errorf("a NATS connection is required to check for other instances")
+	}
+
+	subject, err := micro.ControlSubject(micro.PingVerb, name, "")
+	if err != nil {
+		return err
+	}
+
+	_, err = a.Conn.Request(subject, nil, clusterTimeout)
+	if err == nats.ErrTimeout || err == nats.ErrNoResponders {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("another %s instance is running, every instance needs the same cluster key to share the seal state", name)
+}
+
+// instanceStatus returns the seal state of this instance
+func (a *AppContext) instanceStatus() InstanceStatus {
+	status := InstanceStatus{
+		ID:       a.member.id,
+		Locked:   !a.keys.unlocked(),
+		Progress: a.keys.shareCount(),
+		KeyID:    a.keys.currentID(),
+	}
+
+	if unlockedAt, lastRead := a.keys.activity(); !unlockedAt.IsZero() {
+		status.LastRead = &lastRead
+	}
+
+	if event := a.keys.lastAutoLock(); event != nil {
+		status.AutoLocked = event.Reason
+	}
+
+	if a.member.joined() {
+		status.PublicKey = a.member.publicKey[:]
+	}
+
+	return status
+}
+
+// clusterPayload returns the data signed for a cluster message. The subject is included so a message cannot be
+// sent to another instance or, for status responses, another request.
+func clusterPayload(subject, instance, sent string, data []byte) []byte {
+	return append([]byte(fmt.Sprintf("piggybank cluster\n%s\n%s\n%s\n", subject, instance, sent)), data...)
+}
+
+// signCluster sets the instance, time and signature headers on a message to other instances
+func (a *AppContext) signCluster(msg *nats.Msg) error {
+	sent := strconv.FormatInt(time.Now().UnixNano(), 10)
+	sig, err := a.ClusterKey.Sign(clusterPayload(msg.Subject, a.member.id, sent, msg.Data))
+	if err != nil {
+		return err
+	}
+
+	if msg.Header == nil {
+		msg.Header = nats.Header{}
+	}
+	msg.Header.Set(InstanceHeader, a.member.id)
+	msg.Header.Set(ClusterTimeHeader, sent)
+	msg.Header.Set(SignatureHeader, base64.RawURLEncoding.EncodeToString(sig))
+
+	return nil
+}
+
+// verifyCluster checks that the message was signed with the cluster key within the cluster window. It
+// returns the instance that sent it and when.
+func (a *AppContext) verifyCluster(msg *nats.Msg) (string, int64, error) {
+	instance := msg.Header.Get(InstanceHeader)
+	sent := msg.Header.Get(ClusterTimeHeader)
+
+	sig, err := base64.RawURLEncoding.DecodeString(msg.Header.Get(SignatureHeader))
+	if err != nil || len(sig) == 0 || a.ClusterKey.Verify(clusterPayload(msg.Subject, instance, sent, msg.Data), sig) != nil {
+		return "", 0, fmt.Errorf("invalid cluster signature")
+	}
+
+	nanos, err := strconv.ParseInt(sent, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid cluster time")
+	}
+
+	if age := time.Since(time.Unix(0, nanos)); age > clusterWindow || age < -clusterWindow {
+		return "", 0, fmt.Errorf("cluster message expired")
+	}
+
+	return instance, nanos, nil
+}
+
+func (a *AppContext) handleClusterStatus(msg *nats.Msg) {
+	if _, _, err := a.verifyCluster(msg); err != nil {
+		a.logger.Errorf("dropping status request: %v", err)
+		return
+	}
+
+	data, err := json.Marshal(a.instanceStatus())
+	if err != nil {
+		a.logger.Errorf("error encoding instance status: %v", err)
+		return
+	}
+
+	out := nats.NewMsg(msg.Reply)
+	out.Data = data
+	if err := a.signCluster(out); err != nil {
+		a.logger.Errorf("error signing instance status: %v", err)
+		return
+	}
+
+	if err := a.Conn.PublishMsg(out); err != nil {
+		a.logger.Errorf("error responding with instance status: %v", err)
+	}
+}
+
+// handleClusterLock locks this instance when another instance was locked. Only signed broadcasts are trusted, so
+// the auto-lock event in the broadcast comes from an instance holding the cluster key.
+func (a *AppContext) handleClusterLock(msg *nats.Msg) {
+	sender, sent, err := a.verifyCluster(msg)
+	if err != nil {
+		a.logger.Errorf("dropping cluster lock: %v", err)
+		return
+	}
+
+	if sender == a.member.id {
+		return
+	}
+
+	if !a.member.accept(msg.Subject, sender, sent) {
+		a.logger.Errorf("dropping replayed cluster lock from instance %s", sender)
+		return
+	}
+
+	var event *AutoLockEvent
+	if len(msg.Data) > 0 {
+		event = &AutoLockEvent{}
+		if err := json.Unmarshal(msg.Data, event); err != nil {
+			a.logger.Errorf("invalid auto-lock in cluster lock: %v", err)
+			event = nil
+		}
+	}
+
+	a.logger.Infof("database locked by instance %s", sender)
+	a.sealWith(event)
+}
+
+func (a *AppContext) handleClusterMessage(msg *nats.Msg) {
+	sender, sent, err := a.verifyCluster(msg)
+	if err != nil {
+		a.logger.Errorf("dropping cluster message: %v", err)
+		return
+	}
+
+	if !a.member.accept(msg.Subject, sender, sent) {
+		a.logger.Errorf("dropping replayed cluster message from instance %s", sender)
+		return
+	}
+
+	opened, ok := box.OpenAnonymous(nil, msg.Data, a.member.publicKey, a.member.privateKey)
+	if !ok {
+		a.logger.Error("unable to open cluster message")
+		return
+	}
+	defer zero(opened)
+
+	var cm clusterMessage
+	if err := json.Unmarshal(opened, &cm); err != nil {
+		a.logger.Errorf("invalid cluster message: %v", err)
+		return
+	}
+	defer zero(cm.Data)
+
+	switch cm.Kind {
+	case clusterUnlock:
+		if a.keys.unlocked() {
+			return
+		}
+		remaining, err := a.unlock(cm.Data)
+		if isAuthFailure(err) {
+			a.recordFailure(fmt.Sprintf("instance=%s", sender), fmt.Sprintf("instance=%s", sender), err)
+		}
+		if err != nil {
+			a.logger.Errorf("error applying forwarded unlock: %v", err)
+			return
+		}
+		if remaining == 0 {
+			a.logger.Info("database unlocked by forwarded unlock")
+		}
+	case clusterReload:
+		a.keys.change.Lock()
+		defer a.keys.change.Unlock()
+
+		// only instances that are unlocked follow key changes, a locked instance must be unlocked explicitly
+		if !a.keys.unlocked() {
+			return
+		}
+		if err := a.reloadKey(); err != nil {
+			// a replaced key must never seal new secrets, so the instance locks until it is unlocked again
+			a.logger.Errorf("unable to follow database key change, locking instance: %v", err)
+			a.keys.wipe()
+			return
+		}
+		a.logger.Infof("database key %s loaded from init record", a.keys.currentID())
+	default:
+		a.logger.Errorf("unknown cluster message kind %s", cm.Kind)
+	}
+}
+
+// reloadKey loads the keys from the init record after another instance changed it. A migration or a retired key
+// leaves the database key as it is. After a rotation the new key is unwrapped with this instance's key provider,
+// if the instance has none the rotation cannot be followed. The caller must hold the change lock.
+func (a *AppContext) reloadKey() error {
+	record, err := a.getInitRecord()
+	if err != nil {
+		return err
+	}
+
+	current := append([]byte{}, a.keys.key()...)
+	if err := record.open(current); err == nil {
+		return a.loadKey(current)
+	}
+	zero(current)
+
+	if a.Provider == nil || record.Provider != a.Provider.Name() || record.ProviderKey == nil {
+		return fmt.Errorf("database key was rotated and no key provider can unwrap the new key")
+	}
+
+	key, err := a.Provider.Unwrap(record.ProviderKey)
+	if err != nil {
+		return fmt.Errorf("error unwrapping key with %s provider: %v", a.Provider.Name(), err)
+	}
+
+	return a.loadKey(key)
+}
+
+// peers returns the seal state of every other instance that answers within the cluster timeout. Answers that
+// are not signed with the cluster key are ignored.
+func (a *AppContext) peers() []InstanceStatus {
+	if a.Conn == nil || !a.member.joined() {
+		return nil
+	}
+
+	inbox := a.Conn.NewInbox()
+	sub, err := a.Conn.SubscribeSync(inbox)
+	if err != nil {
+		a.logger.Errorf("error subscribing for instance status: %v", err)
+		return nil
+	}
+	defer sub.Unsubscribe()
+
+	req := nats.NewMsg(fmt.Sprintf("%s.%s", clusterSubject, clusterStatusSubject))
+	req.Reply = inbox
+	if err := a.signCluster(req); err != nil {
+		a.logger.Errorf("error signing instance status request: %v", err)
+		return nil
+	}
+
+	if err := a.Conn.PublishMsg(req); err != nil {
+		a.logger.Errorf("error requesting instance status: %v", err)
+		return nil
+	}
+
+	var peers []InstanceStatus
+	deadline := time.Now().Add(clusterTimeout)
+	for {
+		msg, err := sub.NextMsg(time.Until(deadline))
+		if err != nil {
+			return peers
+		}
+
+		sender, _, err := a.verifyCluster(msg)
+		if err != nil {
+			a.logger.Errorf("ignoring instance status: %v", err)
+			continue
+		}
+
+		var status InstanceStatus
+		if err := json.Unmarshal(msg.Data, &status); err != nil || status.ID != sender || status.ID == a.member.id || len(status.PublicKey) != 32 {
+			continue
+		}
+		peers = append(peers, status)
+	}
+}
+
+// forward seals the message to each peer with its public key and sends it to that instance only
+func (a *AppContext) forward(peers []InstanceStatus, kind string, data []byte) {
+	msg, err := json.Marshal(clusterMessage{Kind: kind, Data: data})
+	if err != nil {
+		a.logger.Errorf("error encoding cluster message: %v", err)
+		return
+	}
+	defer zero(msg)
+
+	for _, peer := range peers {
+		var publicKey [32]byte
+		copy(publicKey[:], peer.PublicKey)
+
+		sealed, err := box.SealAnonymous(nil, msg, &publicKey, rand.Reader)
+		if err != nil {
+			a.logger.Errorf("error sealing cluster message for instance %s: %v", peer.ID, err)
+			continue
+		}
+
+		out := nats.NewMsg(fmt.Sprintf("%s.%s", clusterSubject, peer.ID))
+		out.Data = sealed
+		if err := a.signCluster(out); err != nil {
+			a.logger.Errorf("error signing cluster message for instance %s: %v", peer.ID, err)
+			continue
+		}
+
+		if err := a.Conn.PublishMsg(out); err != nil {
+			a.logger.Errorf("error forwarding %s to instance %s: %v", kind, peer.ID, err)
+		}
+	}
+}
+
+// forwardUnlock sends an accepted unlock request to the other instances
+func (a *AppContext) forwardUnlock(data []byte) {
+	a.forward(a.peers(), clusterUnlock, data)
+}
+
+// syncKey tells the other unlocked instances to reload the keys from the init record after this instance changed them
+func (a *AppContext) syncKey() {
+	if !a.keys.unlocked() {
+		return
+	}
+
+	a.forward(a.peers(), clusterReload, nil)
+}
+
+// broadcastLock locks every other instance. If the lock is an auto-lock the event is sent so the other instances
+// report why they were locked.
+func (a *AppContext) broadcastLock(event *AutoLockEvent) {
+	if a.Conn == nil || !a.member.joined() {
+		return
+	}
+
+	msg := nats.NewMsg(fmt.Sprintf("%s.%s", clusterSubject, clusterLockSubject))
+	if event != nil {
+		data, err := json.Marshal(event)
+		if err != nil {
+			a.logger.Errorf("error encoding auto-lock: %v", err)
+		}
+		msg.Data = data
+	}
+	if err := a.signCluster(msg); err != nil {
+		a.logger.Errorf("error signing lock: %v", err)
+		return
+	}
+	if err := a.Conn.PublishMsg(msg); err != nil {
+		a.logger.Errorf("error broadcasting lock: %v", err)
+	}
+}
+
+// clusterStatus returns the seal state of this instance followed by every other instance
+func (a *AppContext) clusterStatus() []InstanceStatus {
+	return append([]InstanceStatus{a.instanceStatus()}, a.peers()...)
+}
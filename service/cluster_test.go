@@ -0,0 +1,384 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/CoverWhale/logr"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nats-io/nkeys"
+	"golang.org/x/crypto/nacl/box"
+)
+
+// newTestCluster returns instances of the same bank, each with its own NATS connection and the same cluster key
+func newTestCluster(t *testing.T, instances int, configure ...func(*AppContext)) []AppContext {
+	server := NewServer(t)
+	t.Cleanup(func() { shutdownJSServerAndRemoveStorage(t, server) })
+
+	signer, err := nkeys.CreateServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apps := make([]AppContext, instances)
+	for i := range apps {
+		nc, err := nats.Connect(server.ClientURL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(nc.Close)
+
+		js, err := nc.JetStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "piggybank"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		apps[i] = NewAppContext(kv)
+		apps[i].Conn = nc
+		apps[i].logger = logr.NewLogger()
+		apps[i].ClusterKey = signer
+		for _, v := range configure {
+			v(&apps[i])
+		}
+		if err := apps[i].JoinCluster(apps[i].logger); err != nil {
+			t.Fatal(err)
+		}
+		if err := nc.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return apps
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for cluster")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClusterUnlockAndLock(t *testing.T) {
+	apps := newTestCluster(t, 3)
+
+	key, err := apps[0].initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := unlockRequest(t, toBase64(key))
+	if _, err := apps[0].unlock(data); err != nil {
+		t.Fatal(err)
+	}
+	apps[0].forwardUnlock(data)
+
+	for _, app := range apps {
+		waitFor(t, app.keys.unlocked)
+	}
+
+	status, err := apps[1].status(unidentifiedCaller)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Locked || len(status.Instances) != 3 {
+		t.Errorf("expected 3 unlocked instances but got %+v", status)
+	}
+
+	apps[1].Seal()
+	status, err = apps[0].status(unidentifiedCaller)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !status.Locked {
+		t.Error("expected database to be reported locked while an instance is locked")
+	}
+
+	apps[1].broadcastLock(nil)
+	for _, app := range apps {
+		waitFor(t, func() bool { return !app.keys.unlocked() })
+	}
+}
+
+func TestClusterShares(t *testing.T) {
+	apps := newTestCluster(t, 2)
+
+	opts := InitRequest{Shares: 3, Threshold: 2}
+	key, err := apps[0].initialize(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := splitSecret(key, opts.Shares, opts.Threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each share reaches a different instance through the queue group
+	for i, app := range apps {
+		data := unlockRequest(t, toBase64(shares[i]))
+		if _, err := app.unlock(data); err != nil {
+			t.Fatal(err)
+		}
+		app.forwardUnlock(data)
+	}
+
+	for _, app := range apps {
+		waitFor(t, app.keys.unlocked)
+	}
+}
+
+func TestClusterRotation(t *testing.T) {
+	provider, err := NewFileKeyProvider(writeKeyFile(t, toBase64(generateKey())))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	apps := newTestCluster(t, 2, func(a *AppContext) { a.Provider = provider })
+
+	key, err := apps[0].initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, app := range apps {
+		if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newKey, err := apps[0].Rotate(RotateRequest{CurrentKey: toBase64(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apps[0].syncKey()
+
+	// the other instance unwraps the new key from the init record with its own provider
+	waitFor(t, func() bool { return apps[1].keys.currentID() == keyID(newKey) })
+	apps[0].rotation.wait()
+}
+
+func TestClusterRotationWithoutProvider(t *testing.T) {
+	apps := newTestCluster(t, 2)
+
+	key, err := apps[0].initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, app := range apps {
+		if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	newKey, err := apps[0].Rotate(RotateRequest{CurrentKey: toBase64(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	apps[0].syncKey()
+	apps[0].rotation.wait()
+
+	// the new key is never sent, so an instance that cannot unwrap it locks instead of sealing with the old key
+	waitFor(t, func() bool { return !apps[1].keys.unlocked() })
+
+	if _, err := apps[1].unlock(unlockRequest(t, toBase64(newKey))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClusterIgnoresUnsignedPeers(t *testing.T) {
+	apps := newTestCluster(t, 2)
+
+	key, err := apps[0].initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nc, err := nats.Connect(apps[0].Conn.ConnectedUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	// an impostor answers status requests with its own box key and a recent read
+	impostor, err := nkeys.CreateServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stolen := make(chan []byte, 10)
+	fake := AppContext{Conn: nc, ClusterKey: impostor, member: &clusterMember{id: "impostor", publicKey: publicKey, privateKey: privateKey}}
+	if _, err := nc.Subscribe(clusterSubject+"."+clusterStatusSubject, func(msg *nats.Msg) {
+		now := time.Now()
+		data, _ := json.Marshal(InstanceStatus{ID: "impostor", LastRead: &now, PublicKey: publicKey[:]})
+		out := nats.NewMsg(msg.Reply)
+		out.Data = data
+		fake.signCluster(out)
+		nc.PublishMsg(out)
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := nc.Subscribe(clusterSubject+".impostor", func(msg *nats.Msg) { stolen <- msg.Data }); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, peer := range apps[0].peers() {
+		if peer.ID == "impostor" {
+			t.Fatal("expected status signed by another key to be ignored")
+		}
+	}
+
+	data := unlockRequest(t, toBase64(key))
+	if _, err := apps[0].unlock(data); err != nil {
+		t.Fatal(err)
+	}
+	apps[0].forwardUnlock(data)
+	waitFor(t, apps[1].keys.unlocked)
+
+	select {
+	case <-stolen:
+		t.Fatal("expected unlock material not to be forwarded to the impostor")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a forged recent read does not keep the database unlocked
+	policy := AutoLockPolicy{Idle: time.Minute}
+	apps[0].checkAutoLock(policy, time.Now().Add(2*time.Minute))
+	if apps[0].keys.unlocked() {
+		t.Error("expected impostor activity to be ignored by the idle check")
+	}
+
+	// an unsigned message to an instance is dropped
+	apps[1].Seal()
+	sealed, err := box.SealAnonymous(nil, mustJSON(t, clusterMessage{Kind: clusterUnlock, Data: data}), apps[1].member.publicKey, rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Publish(clusterSubject+"."+apps[1].member.id, sealed); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if apps[1].keys.unlocked() {
+		t.Error("expected unsigned unlock message to be dropped")
+	}
+}
+
+func TestClusterIgnoresUnsignedLock(t *testing.T) {
+	apps := newTestCluster(t, 2)
+
+	key, err := apps[0].initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := apps[1].unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	nc, err := nats.Connect(apps[0].Conn.ConnectedUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	impostor, err := nkeys.CreateServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := AppContext{Conn: nc, ClusterKey: impostor, member: &clusterMember{id: "impostor"}}
+
+	event := mustJSON(t, AutoLockEvent{Reason: AutoLockIdle, Details: "forged"})
+	unsigned := nats.NewMsg(clusterSubject + "." + clusterLockSubject)
+	unsigned.Data = event
+	unsigned.Header.Set(InstanceHeader, "impostor")
+	forged := nats.NewMsg(clusterSubject + "." + clusterLockSubject)
+	forged.Data = event
+	if err := fake.signCluster(forged); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []*nats.Msg{unsigned, forged} {
+		if err := nc.PublishMsg(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	if !apps[1].keys.unlocked() {
+		t.Fatal("expected lock broadcasts not signed with the cluster key to be dropped")
+	}
+
+	apps[0].broadcastLock(&AutoLockEvent{Reason: AutoLockIdle, Details: "idle"})
+	waitFor(t, func() bool { return !apps[1].keys.unlocked() })
+	if event := apps[1].keys.lastAutoLock(); event == nil || event.Reason != AutoLockIdle {
+		t.Errorf("expected the signed auto-lock to be recorded but got %+v", event)
+	}
+}
+
+func TestClusterKeyRequired(t *testing.T) {
+	apps := newTestCluster(t, 1)
+
+	nc, err := nats.Connect(apps[0].Conn.ConnectedUrl())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	app := NewAppContext(apps[0].KV)
+	app.Conn = nc
+	if err := app.JoinCluster(apps[0].logger); err == nil {
+		t.Error("expected joining the cluster without a cluster key to fail")
+	}
+
+	if err := app.CheckStandalone("piggybank"); err != nil {
+		t.Errorf("expected no other instance to be found: %v", err)
+	}
+
+	svc, err := micro.AddService(apps[0].Conn, micro.Config{Name: "piggybank", Version: "0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer svc.Stop()
+	if err := apps[0].Conn.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.CheckStandalone("piggybank"); err == nil {
+		t.Error("expected a standalone instance to be refused while another instance is running")
+	}
+}
+
+func mustJSON(t *testing.T, v any) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
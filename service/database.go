@@ -3,35 +3,53 @@ package service
 import (
 	"crypto/aes"
 	"encoding/json"
+	"errors"
 	"fmt"
 
+	"github.com/CoverWhale/logr"
 	"github.com/nats-io/nats.go"
 )
 
 const (
-	databaseSubject              = "piggybank.database"
-	databaseInitSubject          = "initialize"
-	databaseUnlockSubject        = "unlock"
-	databaseLockSubject          = "lock"
-	databaseStatusSubject        = "status"
-	databaseRotateSubject        = "rotate"
-	DBInit                DBVerb = "init"
-	DBLock                DBVerb = "lock"
-	DBUnlock              DBVerb = "unlock"
-	DBStatus              DBVerb = "status"
-	DBRotate              DBVerb = "rotate"
-	GET                   Verb   = "GET"
-	POST                  Verb   = "POST"
-	DELETE                Verb   = "DELETE"
-	secretSubject                = "piggybank.secrets"
+	databaseSubject                    = "piggybank.database"
+	databaseInitSubject                = "initialize"
+	databaseUnlockSubject              = "unlock"
+	databaseLockSubject                = "lock"
+	databaseStatusSubject              = "status"
+	databaseRotateSubject              = "rotate"
+	databaseRotateStatusSubject        = "rotate.status"
+	databaseMigrateSubject             = "migrate"
+	databaseRekeySubject               = "rekey"
+	DBInit                      DBVerb = "init"
+	DBLock                      DBVerb = "lock"
+	DBUnlock                    DBVerb = "unlock"
+	DBStatus                    DBVerb = "status"
+	DBRotate                    DBVerb = "rotate"
+	DBRotateStatus              DBVerb = "rotate-status"
+	DBMigrate                   DBVerb = "migrate"
+	DBRekey                     DBVerb = "rekey"
+	GET                         Verb   = "GET"
+	POST                        Verb   = "POST"
+	DELETE                      Verb   = "DELETE"
+	HISTORY                     Verb   = "HISTORY"
+	ROLLBACK                    Verb   = "ROLLBACK"
+	META                        Verb   = "META"
+	LIST                        Verb   = "LIST"
+	secretSubject                      = "piggybank.secrets"
+	eventSubject                       = "piggybank.events"
+	ExpectedRevisionHeader             = "Piggybank-Expected-Revision"
+	RevisionHeader                     = "Piggybank-Revision"
 )
 
 var SubjectVerbs = map[DBVerb]string{
-	DBInit:   fmt.Sprintf("%s.%s", databaseSubject, databaseInitSubject),
-	DBLock:   fmt.Sprintf("%s.%s", databaseSubject, databaseLockSubject),
-	DBUnlock: fmt.Sprintf("%s.%s", databaseSubject, databaseUnlockSubject),
-	DBStatus: fmt.Sprintf("%s.%s", databaseSubject, databaseStatusSubject),
-	DBRotate: fmt.Sprintf("%s.%s", databaseSubject, databaseRotateSubject),
+	DBInit:         fmt.Sprintf("%s.%s", databaseSubject, databaseInitSubject),
+	DBLock:         fmt.Sprintf("%s.%s", databaseSubject, databaseLockSubject),
+	DBUnlock:       fmt.Sprintf("%s.%s", databaseSubject, databaseUnlockSubject),
+	DBStatus:       fmt.Sprintf("%s.%s", databaseSubject, databaseStatusSubject),
+	DBRotate:       fmt.Sprintf("%s.%s", databaseSubject, databaseRotateSubject),
+	DBRotateStatus: fmt.Sprintf("%s.%s", databaseSubject, databaseRotateStatusSubject),
+	DBMigrate:      fmt.Sprintf("%s.%s", databaseSubject, databaseMigrateSubject),
+	DBRekey:        fmt.Sprintf("%s.%s", databaseSubject, databaseRekeySubject),
 }
 
 type DBVerb string
@@ -58,18 +76,340 @@ type Backend interface {
 }
 
 func GetClientDBVerbs() []string {
-	return []string{DBInit.String(), DBLock.String(), DBUnlock.String(), DBStatus.String(), DBRotate.String()}
+	return []string{DBInit.String(), DBLock.String(), DBUnlock.String(), DBStatus.String(), DBRotate.String(), DBRotateStatus.String(), DBMigrate.String(), DBRekey.String()}
 }
 
-// initialize sets the initialization key. Once this is set it does not need to be run again, unless you lose the encryption key.
-// If you lose the encryption key, everything is lost.
-func (a *AppContext) initialize() ([]byte, error) {
+// initRecord is stored under the init key. It holds the unseal configuration for the database
+// along with a check value encrypted with the database key, which is used to validate keys on unlock.
+// The migration state is sealed in the check value so it cannot be changed without the database key.
+// Previous database keys that still wrap secrets are stored in the keyring, encrypted with the database key.
+// If a key provider is configured the database key is also stored wrapped by the provider for auto unlock.
+type initRecord struct {
+	Shares        int    `json:"shares,omitempty"`
+	Threshold     int    `json:"threshold,omitempty"`
+	Algorithm     string `json:"algorithm,omitempty"`
+	Check         []byte `json:"check"`
+	Keyring       []byte `json:"keyring,omitempty"`
+	Provider      string `json:"provider,omitempty"`
+	ProviderKey   []byte `json:"provider_key,omitempty"`
+	ProviderKeyID string `json:"provider_key_id,omitempty"`
+	// KDF is set when the database key is wrapped by a key derived from a passphrase
+	KDF *kdfParams `json:"kdf,omitempty"`
+	// WrappedKey is the database key wrapped by the unseal key or the key derived from the passphrase. Databases
+	// that have not been rekeyed or protected by a passphrase are unlocked with the database key itself.
+	WrappedKey   []byte `json:"wrapped_key,omitempty"`
+	WrappedKeyID string `json:"wrapped_key_id,omitempty"`
+	// Migrated is set once every secret is in the current envelope format. From then on values in older
+	// formats are refused, including older revisions kept in the bucket history.
+	Migrated bool `json:"-"`
+	// LegacyRevision is the last revision in the bucket when the database was first unlocked by a version that
+	// binds envelopes to their name. Until the database is migrated, values in older formats are only opened at
+	// or below it, so a legacy value copied to another secret is refused.
+	LegacyRevision uint64 `json:"-"`
+	// kek is the unseal key or the key derived from the passphrase, it is only set when the database key is being wrapped again
+	kek []byte
+}
+
+// checkState is the plaintext of the check value. The random value makes every check value unique.
+type checkState struct {
+	Random         string `json:"random"`
+	Migrated       bool   `json:"migrated,omitempty"`
+	LegacyRevision uint64 `json:"legacy_revision,omitempty"`
+}
+
+// open validates the key against the check value and loads the migration state sealed in it. Check values
+// written before the state was sealed in them hold a random value only, so the database is not migrated
+// and its legacy revision is set again when the key is loaded.
+func (i *initRecord) open(key []byte) error {
+	plaintext, err := decrypt(i.Check, key)
+	if err != nil {
+		return NewClientError(fmt.Errorf("invalid database key"), 401)
+	}
+
+	var state checkState
+	if err := json.Unmarshal(plaintext, &state); err != nil {
+		state = checkState{}
+	}
+	i.Migrated, i.LegacyRevision = state.Migrated, state.LegacyRevision
+
+	return nil
+}
+
+// InitRequest holds the options for initializing the database. If Shares is set the database key is split
+// into that many shares, Threshold of which are required to unlock the database. If Passphrase is set the
+// database key is wrapped by a key derived from the passphrase. Algorithm selects the cipher
+// used to seal secrets and defaults to AES-256-GCM.
+type InitRequest struct {
+	Shares     int    `json:"shares,omitempty"`
+	Threshold  int    `json:"threshold,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+	Algorithm  string `json:"algorithm,omitempty"`
+}
+
+// Validate checks the share configuration, passphrase and algorithm for the init request
+func (i InitRequest) Validate() error {
+	if _, err := getCipher(i.Algorithm); err != nil {
+		return NewClientError(err, 400)
+	}
+
+	if i.Passphrase != "" {
+		if i.Shares != 0 || i.Threshold != 0 {
+			return NewClientError(fmt.Errorf("a passphrase cannot be combined with shares"), 400)
+		}
+		return validatePassphrase(i.Passphrase)
+	}
+
+	if i.Shares == 0 && i.Threshold == 0 {
+		return nil
+	}
+
+	if i.Shares < 2 || i.Shares > maxShares {
+		return NewClientError(fmt.Errorf("shares must be between 2 and %d", maxShares), 400)
+	}
+
+	if i.Threshold < 2 || i.Threshold > i.Shares {
+		return NewClientError(fmt.Errorf("threshold must be between 2 and the number of shares"), 400)
+	}
+
+	return nil
+}
+
+// sharded returns true if the database key is split into shares
+func (i initRecord) sharded() bool {
+	return i.Threshold > 1
+}
+
+// wrapped returns true if the database is unlocked with material that wraps the database key
+// instead of the database key itself
+func (i initRecord) wrapped() bool {
+	return i.KDF != nil || i.WrappedKey != nil
+}
+
+// getInitRecord returns the init record. Databases initialized before the init record held any
+// configuration only stored the encrypted check value, so those are returned as the check.
+func (a *AppContext) getInitRecord() (initRecord, error) {
+	record, _, err := a.getInitRecordRevision()
+	return record, err
+}
+
+// getInitRecordRevision returns the init record along with its revision in the bucket
+func (a *AppContext) getInitRecordRevision() (initRecord, uint64, error) {
+	entry, err := a.KV.Get(initKey)
+	if err != nil {
+		return initRecord{}, 0, err
+	}
+
+	var record initRecord
+	if err := json.Unmarshal(entry.Value(), &record); err != nil || record.Check == nil {
+		return initRecord{Check: entry.Value()}, entry.Revision(), nil
+	}
+
+	return record, entry.Revision(), nil
+}
+
+// putInitRecord stores the init record with a new check value and the previous keys encrypted with the passed in key
+func (a *AppContext) putInitRecord(record initRecord, key []byte) error {
+	data, err := a.encodeInitRecord(record, key)
+	if err != nil {
+		return err
+	}
+
 	kv := JetStreamRecord{
 		bucket: piggyBucket,
-		key:    "init",
+		key:    initKey,
+		value:  data,
+	}
+
+	return a.AddRecord(&kv)
+}
+
+// encodeInitRecord sets the check value, keyring and wrapped keys for the passed in key and returns the encoded record.
+// The migration state of the record is sealed in the check value.
+func (a *AppContext) encodeInitRecord(record initRecord, key []byte) ([]byte, error) {
+	state, err := json.Marshal(checkState{
+		Random:         generatePass(),
+		Migrated:       record.Migrated,
+		LegacyRevision: record.LegacyRevision,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	check, err := encrypt(state, key)
+	if err != nil {
+		return nil, err
+	}
+	record.Check = check
+
+	record.Keyring = nil
+	if previous := a.keys.previousKeys(); len(previous) > 0 {
+		encoded, err := previous.encode(key)
+		if err != nil {
+			return nil, err
+		}
+		record.Keyring = encoded
+	}
+
+	if err := a.wrapProviderKey(&record, key); err != nil {
+		return nil, err
+	}
+
+	if err := wrapUnsealKey(&record, key); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(record)
+}
+
+// wrapProviderKey stores the key wrapped by the configured key provider in the init record. If no provider
+// is configured a provider key for a different database key is removed since it can no longer unlock the database.
+func (a *AppContext) wrapProviderKey(record *initRecord, key []byte) error {
+	if a.Provider == nil {
+		if record.ProviderKeyID != keyID(key) {
+			record.Provider, record.ProviderKey, record.ProviderKeyID = "", nil, ""
+		}
+		return nil
+	}
+
+	wrapped, err := a.Provider.Wrap(key)
+	if err != nil {
+		return fmt.Errorf("error wrapping key with %s provider: %v", a.Provider.Name(), err)
+	}
+
+	record.Provider = a.Provider.Name()
+	record.ProviderKey = wrapped
+	record.ProviderKeyID = keyID(key)
+
+	return nil
+}
+
+// wrapUnsealKey stores the key wrapped by the unseal key or the key derived from the passphrase in the init
+// record. The wrapping key is only available when the caller sent the unseal material, so changing the database
+// key of a wrapped database without it is an error.
+func wrapUnsealKey(record *initRecord, key []byte) error {
+	if record.kek == nil {
+		if record.wrapped() && record.WrappedKeyID != keyID(key) {
+			return NewClientError(fmt.Errorf("unseal material required to change the database key"), 400)
+		}
+		return nil
+	}
+
+	wrapped, err := encrypt(key, record.kek)
+	if err != nil {
+		return err
 	}
 
-	_, err := a.GetRecord(&kv)
+	record.WrappedKey = wrapped
+	record.WrappedKeyID = keyID(key)
+
+	return nil
+}
+
+// resolveKey returns the database key from the key, shares or passphrase sent by the caller. When the database key
+// is wrapped, the unseal key or the key derived from the passphrase is also returned so the database key can be wrapped again.
+func (i initRecord) resolveKey(key string, shares []string, passphrase string) ([]byte, []byte, error) {
+	if passphrase != "" {
+		if i.KDF == nil {
+			return nil, nil, NewClientError(fmt.Errorf("database is not protected by a passphrase"), 400)
+		}
+
+		kek, err := i.KDF.derive(passphrase)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		unwrapped, err := decrypt(i.WrappedKey, kek)
+		if err != nil {
+			return nil, nil, NewClientError(fmt.Errorf("invalid passphrase"), 401)
+		}
+
+		return unwrapped, kek, nil
+	}
+
+	if i.KDF != nil {
+		return nil, nil, NewClientError(fmt.Errorf("database is protected by a passphrase"), 400)
+	}
+
+	if len(shares) > 0 {
+		combined, err := keyFromShares(shares)
+		if err != nil {
+			return nil, nil, err
+		}
+		key = combined
+	}
+
+	if key == "" {
+		return nil, nil, NewClientError(fmt.Errorf("current db key required"), 400)
+	}
+
+	decoded, err := fromBase64(key)
+	if err != nil {
+		return nil, nil, NewClientError(fmt.Errorf("%v", err), 400)
+	}
+
+	if i.WrappedKey == nil {
+		return decoded, nil, nil
+	}
+
+	unwrapped, err := decrypt(i.WrappedKey, decoded)
+	if err != nil {
+		return nil, nil, NewClientError(fmt.Errorf("invalid unseal key"), 401)
+	}
+
+	return unwrapped, decoded, nil
+}
+
+// AutoUnlock unlocks the database with the key wrapped by the configured key provider. Databases that were
+// initialized before the provider was configured are wrapped the next time they are unlocked manually.
+func (a *AppContext) AutoUnlock(logger *logr.Logger) error {
+	a.logger = logger
+	if a.Provider == nil {
+		return nil
+	}
+
+	record, err := a.getInitRecord()
+	if err == nats.ErrKeyNotFound {
+		logger.Info("database not initialized, skipping auto unlock")
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if record.ProviderKey == nil || record.Provider != a.Provider.Name() {
+		logger.Infof("database key is not wrapped by the %s provider, unlock manually to enable auto unlock", a.Provider.Name())
+		return nil
+	}
+
+	key, err := a.Provider.Unwrap(record.ProviderKey)
+	if err != nil {
+		return fmt.Errorf("error unwrapping key with %s provider: %v", a.Provider.Name(), err)
+	}
+
+	kv := JetStreamRecord{
+		bucket: piggyBucket,
+		key:    initKey,
+		value:  []byte(toBase64(key)),
+	}
+
+	if err := a.Unlock(&kv); err != nil {
+		return fmt.Errorf("error unlocking database: %v", err)
+	}
+
+	logger.Infof("database unlocked with %s provider", a.Provider.Name())
+
+	return nil
+}
+
+// initialize sets the initialization key. Once this is set it does not need to be run again, unless you lose the encryption key.
+// If you lose the encryption key, everything is lost.
+func (a *AppContext) initialize(opts InitRequest) ([]byte, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	_, err := a.getInitRecord()
 	if err != nil && err != nats.ErrKeyNotFound {
 		return nil, err
 	}
@@ -79,20 +419,27 @@ func (a *AppContext) initialize() ([]byte, error) {
 	}
 
 	a.logger.Info("generating intial key")
-	key, random := generateKey(), generatePass()
-
-	record := JetStreamRecord{
-		encryptionKey: key,
-		bucket:        piggyBucket,
-		key:           "init",
-		value:         []byte(random),
+	key := generateKey()
+
+	// a new database has no secrets in older formats
+	record := initRecord{
+		Shares:    opts.Shares,
+		Threshold: opts.Threshold,
+		Algorithm: opts.Algorithm,
+		Migrated:  true,
 	}
 
-	if err := record.Encrypt(); err != nil {
-		return nil, err
+	if opts.Passphrase != "" {
+		kdf := newKDFParams()
+		kek, err := kdf.derive(opts.Passphrase)
+		if err != nil {
+			return nil, err
+		}
+		record.KDF = &kdf
+		record.kek = kek
 	}
 
-	if err := a.AddRecord(&record); err != nil {
+	if err := a.putInitRecord(record, key); err != nil {
 		return nil, err
 	}
 
@@ -100,57 +447,236 @@ func (a *AppContext) initialize() ([]byte, error) {
 
 }
 
+// keyResponse builds the response holding a new database key. If the database is configured
+// for shares the key is split and only the shares are returned.
+func keyResponse(key []byte, record initRecord, details string) (ResponseMessage, error) {
+	// the key never leaves the service when it is wrapped by the unseal material
+	if record.KDF != nil {
+		return ResponseMessage{Details: fmt.Sprintf("%s, unlock with the passphrase", details)}, nil
+	}
+
+	if record.wrapped() {
+		return ResponseMessage{Details: fmt.Sprintf("%s, unlock with the existing unseal key", details)}, nil
+	}
+
+	if !record.sharded() {
+		return ResponseMessage{Details: toBase64(key)}, nil
+	}
+
+	shares, err := splitSecret(key, record.Shares, record.Threshold)
+	if err != nil {
+		return ResponseMessage{}, err
+	}
+
+	resp := ResponseMessage{
+		Details: fmt.Sprintf("%s, %d of %d shares are required to unlock", details, record.Threshold, record.Shares),
+	}
+	for _, v := range shares {
+		resp.Shares = append(resp.Shares, toBase64(v))
+	}
+
+	return resp, nil
+}
+
+// keyFromShares combines base64 encoded shares and returns the base64 encoded database key
+func keyFromShares(shares []string) (string, error) {
+	decoded := make([][]byte, len(shares))
+	for i, v := range shares {
+		share, err := fromBase64(v)
+		if err != nil {
+			return "", NewClientError(fmt.Errorf("invalid share: %v", err), 400)
+		}
+		decoded[i] = share
+	}
+
+	key, err := combineShares(decoded)
+	if err != nil {
+		return "", NewClientError(err, 400)
+	}
+
+	return toBase64(key), nil
+}
+
+// Unlock unlocks the database with the base64 encoded database key in the value of k
 func (a *AppContext) Unlock(k KV) error {
+	a.keys.change.Lock()
+	defer a.keys.change.Unlock()
+
+	return a.unlockKey(k)
+}
+
+// unlockKey validates the key against the init record, loads it with the keyring and resumes any interrupted
+// rotation. The caller must hold the change lock.
+func (a *AppContext) unlockKey(k KV) error {
 	key, err := fromBase64(string(k.Value()))
 	if err != nil {
 		return err
 	}
 
-	val, err := a.GetRecord(k)
+	if err := a.loadKey(key); err != nil {
+		return err
+	}
+
+	a.resumeRotation()
+
+	return nil
+}
+
+// loadKey validates the key against the init record and loads it with the keyring and cipher from the record.
+// The caller must hold the change lock.
+func (a *AppContext) loadKey(key []byte) error {
+	record, err := a.getInitRecord()
+	if err != nil {
+		return err
+	}
+
+	if err := record.open(key); err != nil {
+		return err
+	}
+
+	previous, err := decodeKeyring(record.Keyring, key)
 	if err != nil {
 		return err
 	}
 
-	_, err = decrypt(val, key)
+	c, err := getCipher(record.Algorithm)
 	if err != nil {
 		return err
 	}
 
-	databaseKey = key
+	a.keys.set(key, previous, c)
+
+	return a.loadLegacyRevision(record)
+}
+
+// loadLegacyRevision sets the last revision legacy values are opened at. Databases created before the cutoff
+// was kept have it set to the current revision of the bucket the first time they are unlocked. The caller
+// must hold the change lock.
+func (a *AppContext) loadLegacyRevision(record initRecord) error {
+	if record.Migrated {
+		a.keys.setLegacyRevision(0)
+		return nil
+	}
+
+	if record.LegacyRevision == 0 {
+		revision, err := a.lastRevision()
+		if err != nil {
+			return err
+		}
+
+		record.LegacyRevision = revision
+		if err := a.putInitRecord(record, a.keys.key()); err != nil {
+			return err
+		}
+	}
+
+	a.keys.setLegacyRevision(record.LegacyRevision)
 
 	return nil
 }
 
-func (a *AppContext) unlock(data []byte) error {
+// lastRevision returns the revision of the last value written to the bucket
+func (a *AppContext) lastRevision() (uint64, error) {
+	status, err := a.KV.Status()
+	if err != nil {
+		return 0, err
+	}
+
+	js, ok := status.(*nats.KeyValueBucketStatus)
+	if !ok {
+		return 0, fmt.Errorf("unable to read the last revision of bucket %s", status.Bucket())
+	}
+
+	return js.StreamInfo().State.LastSeq, nil
+}
+
+// unlock unlocks the database with the key sent in the request. If the database key is split into shares,
+// the share is held until the threshold is met. The number of shares still required is returned.
+func (a *AppContext) unlock(data []byte) (int, error) {
 	var key DatabaseKey
 
-	if databaseKey != nil {
-		return NewClientError(fmt.Errorf("database already unlocked"), 400)
+	a.keys.change.Lock()
+	defer a.keys.change.Unlock()
+
+	if a.keys.unlocked() {
+		return 0, NewClientError(fmt.Errorf("database already unlocked"), 400)
 	}
 
 	if err := json.Unmarshal(data, &key); err != nil {
-		return err
+		return 0, err
+	}
+
+	record, err := a.getInitRecord()
+	if err != nil {
+		return 0, err
 	}
 
-	if key.DBKey == "" || len(key.DBKey) < aes.BlockSize {
-		return NewClientError(fmt.Errorf("key is too short"), 400)
+	if key.Passphrase == "" && (key.DBKey == "" || len(key.DBKey) < aes.BlockSize) {
+		return 0, NewClientError(fmt.Errorf("key is too short"), 400)
+	}
+
+	if key.Passphrase == "" && record.sharded() {
+		remaining, err := a.addShare(key.DBKey, record.Threshold)
+		if err != nil || remaining > 0 {
+			return remaining, err
+		}
+
+		combined, err := keyFromShares(a.keys.takeShares())
+		if err != nil {
+			return 0, err
+		}
+		key.DBKey = combined
+	}
+
+	unwrapped, _, err := record.resolveKey(key.DBKey, nil, key.Passphrase)
+	if err != nil {
+		return 0, err
 	}
 
 	kv := JetStreamRecord{
 		bucket: piggyBucket,
-		key:    "init",
-		value:  []byte(key.DBKey),
+		key:    initKey,
+		value:  []byte(toBase64(unwrapped)),
 	}
 
-	if err := a.Unlock(&kv); err != nil {
-		return fmt.Errorf("error unlocking database: %v", err)
+	if err := a.unlockKey(&kv); err != nil {
+		return 0, fmt.Errorf("error unlocking database: %w", err)
 	}
 
-	return nil
+	if a.Provider != nil && record.ProviderKeyID != a.keys.currentID() {
+		a.logger.Infof("wrapping database key with %s provider", a.Provider.Name())
+		// loading the key can update the init record, so the latest one is wrapped
+		record, err := a.getInitRecord()
+		if err == nil {
+			err = record.open(a.keys.key())
+		}
+		if err == nil {
+			err = a.putInitRecord(record, a.keys.key())
+		}
+		if err != nil {
+			a.logger.Errorf("error wrapping database key with provider: %v", err)
+		}
+	}
+
+	return 0, nil
+}
+
+// addShare holds a submitted unseal share and returns the number of shares still required to meet the threshold
+func (a *AppContext) addShare(share string, threshold int) (int, error) {
+	submitted, err := a.keys.addShare(share)
+	if err != nil {
+		return 0, err
+	}
+
+	a.logger.Infof("unseal share accepted, %d of %d submitted", submitted, threshold)
+
+	return threshold - submitted, nil
 }
 
 // addRecord wraps AddRecord by encrypting the data first and handling responses
 func (a *AppContext) addRecord(k KV) error {
+	a.keys.change.RLock()
+	defer a.keys.change.RUnlock()
 
 	if err := k.Encrypt(); err != nil {
 		return err
@@ -172,23 +698,78 @@ func (a *AppContext) AddRecord(k KV) error {
 	return nil
 }
 
-// getRecord wraps GetRecord by decrypting the returned value and handling resposnes.
-func (a *AppContext) getRecord(k KV, decryptionKey []byte) ([]byte, error) {
-	data, err := a.GetRecord(k)
+// putRecord encrypts the record, stores it and returns its new revision
+func (a *AppContext) putRecord(k KV) (uint64, error) {
+	a.keys.change.RLock()
+	defer a.keys.change.RUnlock()
+
+	if err := k.Encrypt(); err != nil {
+		return 0, err
+	}
+
+	return a.KV.Put(k.Key(), k.Value())
+}
+
+// updateRecord wraps UpdateRecord by encrypting the data first and handling responses. The record is only stored
+// if the secret is at the expected revision. A revision of 0 requires that the secret does not exist.
+func (a *AppContext) updateRecord(k KV, revision uint64) (uint64, error) {
+	a.keys.change.RLock()
+	defer a.keys.change.RUnlock()
+
+	if err := k.Encrypt(); err != nil {
+		return 0, err
+	}
+
+	newRevision, err := a.UpdateRecord(k, revision)
+	if err != nil && isRevisionConflict(err) {
+		return 0, NewClientError(fmt.Errorf("secret is not at revision %d", revision), 409)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newRevision, nil
+}
+
+// UpdateRecord stores the record only if the key is at the expected revision and returns the new revision.
+func (a *AppContext) UpdateRecord(k KV, revision uint64) (uint64, error) {
+	if revision == 0 {
+		return a.KV.Create(k.Key(), k.Value())
+	}
+
+	return a.KV.Update(k.Key(), k.Value(), revision)
+}
+
+// isRevisionConflict returns true if a revision checked write failed because the key was changed
+func isRevisionConflict(err error) bool {
+	return errors.Is(err, nats.ErrKeyExists)
+}
+
+// getRecord wraps GetRecord by decrypting the returned value with the matching key in the keyring and handling resposnes.
+func (a *AppContext) getRecord(k KV) ([]byte, error) {
+	decrypted, _, err := a.getRecordRevision(k)
+	return decrypted, err
+}
+
+// getRecordRevision works like getRecord and also returns the revision of the secret
+func (a *AppContext) getRecordRevision(k KV) ([]byte, uint64, error) {
+	entry, err := a.KV.Get(k.Key())
 	if err != nil && err == nats.ErrKeyNotFound {
-		return nil, NewClientError(fmt.Errorf("key not found"), 404)
+		return nil, 0, NewClientError(fmt.Errorf("key not found"), 404)
 	}
 
 	if err != nil && err != nats.ErrKeyNotFound {
-		return nil, err
+		return nil, 0, err
 	}
 
-	decrypted, err := decrypt(data, decryptionKey)
+	decrypted, err := a.keys.open(k.Key(), entry.Revision(), entry.Value())
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
+	a.keys.touch()
 
-	return decrypted, nil
+	return decrypted, entry.Revision(), nil
 
 }
 
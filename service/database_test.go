@@ -0,0 +1,180 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/CoverWhale/logr"
+	"github.com/nats-io/nats.go"
+)
+
+func newTestApp(t *testing.T) AppContext {
+	server := NewServer(t)
+	t.Cleanup(func() { shutdownJSServerAndRemoveStorage(t, server) })
+
+	nc, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "piggybank"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := NewAppContext(kv)
+	app.logger = logr.NewLogger()
+
+	return app
+}
+
+func unlockRequest(t *testing.T, key string) []byte {
+	data, err := json.Marshal(DatabaseKey{DBKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+func TestUnlockShares(t *testing.T) {
+	app := newTestApp(t)
+
+	opts := InitRequest{Shares: 5, Threshold: 3}
+	key, err := app.initialize(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := keyResponse(key, initRecord{Shares: opts.Shares, Threshold: opts.Threshold}, "database initialized")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(resp.Shares) != 5 {
+		t.Fatalf("expected 5 shares but got %d", len(resp.Shares))
+	}
+
+	for i, share := range resp.Shares[1:4] {
+		remaining, err := app.unlock(unlockRequest(t, share))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if remaining != 2-i {
+			t.Errorf("expected %d remaining but got %d", 2-i, remaining)
+		}
+	}
+
+	if !app.keys.unlocked() {
+		t.Fatal("expected database to be unlocked")
+	}
+
+	if string(app.keys.key()) != string(key) {
+		t.Error("combined key does not match database key")
+	}
+}
+
+func TestUnlockDuplicateShare(t *testing.T) {
+	app := newTestApp(t)
+
+	opts := InitRequest{Shares: 3, Threshold: 2}
+	key, err := app.initialize(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shares, err := splitSecret(key, opts.Shares, opts.Threshold)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	share := toBase64(shares[0])
+	if _, err := app.unlock(unlockRequest(t, share)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.unlock(unlockRequest(t, share)); err == nil {
+		t.Error("expected error for duplicate share")
+	}
+
+	if app.keys.unlocked() {
+		t.Error("expected database to be locked")
+	}
+}
+
+func TestUpdateRecordRevision(t *testing.T) {
+	app := newTestApp(t)
+
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	newRecord := func(value string) *JetStreamRecord {
+		return &JetStreamRecord{
+			bucket: piggyBucket,
+			key:    "app.password",
+			value:  []byte(value),
+			keys:   app.keys,
+		}
+	}
+
+	first, err := app.updateRecord(newRecord("first"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name     string
+		revision uint64
+		code     int
+	}{
+		{name: "create existing secret", revision: 0, code: 409},
+		{name: "stale revision", revision: first + 10, code: 409},
+		{name: "current revision", revision: first, code: 0},
+		{name: "replayed revision", revision: first, code: 409},
+	}
+
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			_, err := app.updateRecord(newRecord(v.name), v.revision)
+			if v.code == 0 && err != nil {
+				t.Fatal(err)
+			}
+
+			if v.code == 0 {
+				return
+			}
+
+			var ce ClientError
+			if !errors.As(err, &ce) || ce.Code != v.code {
+				t.Errorf("expected client error %d but got %v", v.code, err)
+			}
+		})
+	}
+
+	decrypted, revision, err := app.getRecordRevision(newRecord(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(decrypted) != "current revision" {
+		t.Errorf("expected current revision but got %s", decrypted)
+	}
+
+	if revision <= first {
+		t.Errorf("expected revision to be greater than %d but got %d", first, revision)
+	}
+}
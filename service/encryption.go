@@ -1,11 +1,10 @@
 package service
 
 import (
-	"crypto/aes"
-	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
-	"errors"
+	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 )
@@ -40,46 +39,155 @@ func generateKey() []byte {
 // encrypt takes a plain text secret and a 32 bit key and encrypts
 // the secret using the key. It returns the encrypted text or an error.
 func encrypt(plaintext []byte, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key[:])
+	return aesGCM{}.Seal(plaintext, key, nil)
+}
+
+// decrypt takes a byte slice and a 32 bit key and decrypts
+// the secret using the key. It returns the decrypted value
+// or an error.
+func decrypt(ciphertext, key []byte) ([]byte, error) {
+	return aesGCM{}.Open(ciphertext, key, nil)
+}
+
+const (
+	envelopeVersion = 2
+)
+
+// envelope is the stored format of a secret. Each secret is sealed with its own random data key
+// and the data key is stored next to the value, wrapped by the database key. Rotating the database
+// key only requires wrapping the data keys again. The version, key ID and algorithm identify
+// how the envelope was sealed and which database key wrapped it. From version 2 the name of the secret
+// and the version are authenticated as additional data, so an envelope cannot be copied to another secret.
+type envelope struct {
+	Version int    `json:"version,omitempty"`
+	KeyID   string `json:"kid,omitempty"`
+	Alg     string `json:"alg,omitempty"`
+	Key     []byte `json:"key"`
+	Value   []byte `json:"value"`
+}
+
+// validate checks that the envelope was written in a format this version of piggybank understands
+func (e envelope) validate() error {
+	if e.Version > envelopeVersion {
+		return fmt.Errorf("unsupported record version %d", e.Version)
+	}
+
+	_, err := getCipher(e.Alg)
+
+	return err
+}
+
+// additionalData returns the data authenticated with an envelope. Envelopes before version 2 were
+// sealed without additional data.
+func additionalData(name string, version int) []byte {
+	if version < 2 {
+		return nil
+	}
+
+	return []byte(fmt.Sprintf("piggybank:v%d:%s", version, name))
+}
+
+// current returns true if the envelope is in the latest format, sealed with the cipher and wrapped by the key
+func (e envelope) current(c Cipher, key []byte) bool {
+	return e.Version == envelopeVersion && e.Alg == c.ID() && e.KeyID == keyID(key)
+}
+
+// parseEnvelope returns the envelope stored in data. Secrets written before envelope encryption
+// was added are sealed directly with the database key, in that case false is returned.
+func parseEnvelope(data []byte) (envelope, bool) {
+	var env envelope
+	if err := json.Unmarshal(data, &env); err != nil {
+		return envelope{}, false
+	}
+
+	if env.Key == nil || env.Value == nil {
+		return envelope{}, false
+	}
+
+	return env, true
+}
+
+// sealEnvelope encrypts the plaintext with a new data key and wraps the data key with the
+// database key, both bound to the secret name. It returns the encoded envelope.
+func sealEnvelope(c Cipher, name string, plaintext, key []byte) ([]byte, error) {
+	dataKey := generateKey()
+	aad := additionalData(name, envelopeVersion)
+
+	value, err := c.Seal(plaintext, dataKey, aad)
 	if err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	wrapped, err := c.Seal(dataKey, key, aad)
 	if err != nil {
 		return nil, err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	_, err = io.ReadFull(rand.Reader, nonce)
+	return json.Marshal(envelope{
+		Version: envelopeVersion,
+		KeyID:   keyID(key),
+		Alg:     c.ID(),
+		Key:     wrapped,
+		Value:   value,
+	})
+}
+
+// openEnvelope unwraps the data key with the database key and decrypts the value using the cipher
+// recorded in the envelope. Values that are not stored in an envelope are decrypted directly with the database key.
+func openEnvelope(name string, data, key []byte) ([]byte, error) {
+	env, ok := parseEnvelope(data)
+	if !ok {
+		return decrypt(data, key)
+	}
+
+	if err := env.validate(); err != nil {
+		return nil, err
+	}
+
+	c, err := getCipher(env.Alg)
 	if err != nil {
 		return nil, err
 	}
 
-	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+	aad := additionalData(name, env.Version)
+	dataKey, err := c.Open(env.Key, key, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.Open(env.Value, dataKey, aad)
 }
 
-// decrypt takes a byte slice and a 32 bit key and decrypts
-// the secret using the key. It returns the decrypted value
-// or an error.
-func decrypt(ciphertext, key []byte) ([]byte, error) {
-	block, err := aes.NewCipher(key[:])
-	if err != nil {
+// rewrapEnvelope wraps the data key of an envelope with a new database key. The value itself is
+// not decrypted. Values that are not stored in the latest envelope format, or were sealed with a different
+// cipher, are opened and sealed into a new envelope.
+func rewrapEnvelope(c Cipher, name string, data, oldKey, newKey []byte) ([]byte, error) {
+	env, ok := parseEnvelope(data)
+	if !ok || env.Version < envelopeVersion || env.Alg != c.ID() {
+		plaintext, err := openEnvelope(name, data, oldKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return sealEnvelope(c, name, plaintext, newKey)
+	}
+
+	if err := env.validate(); err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
+	aad := additionalData(name, env.Version)
+	dataKey, err := c.Open(env.Key, oldKey, aad)
 	if err != nil {
 		return nil, err
 	}
 
-	if len(ciphertext) < gcm.NonceSize() {
-		return nil, errors.New("malformed ciphertext")
+	wrapped, err := c.Seal(dataKey, newKey, aad)
+	if err != nil {
+		return nil, err
 	}
+	env.KeyID = keyID(newKey)
+	env.Key = wrapped
 
-	return gcm.Open(nil,
-		ciphertext[:gcm.NonceSize()],
-		ciphertext[gcm.NonceSize():],
-		nil,
-	)
+	return json.Marshal(env)
 }
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"encoding/json"
+	"errors"
 	"testing"
 )
 
@@ -50,3 +52,274 @@ func TestFromBase64(t *testing.T) {
 		}
 	}
 }
+
+func TestEnvelope(t *testing.T) {
+	key := generateKey()
+	newKey := generateKey()
+	secret := []byte("piggybank rules")
+
+	sealed, err := sealEnvelope(aesGCM{}, "app.secret", secret, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := openEnvelope("app.secret", sealed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(opened) != string(secret) {
+		t.Errorf("expected %s, but got %s", secret, opened)
+	}
+
+	rewrapped, err := rewrapEnvelope(aesGCM{}, "app.secret", sealed, key, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before, _ := parseEnvelope(sealed)
+	after, ok := parseEnvelope(rewrapped)
+	if !ok {
+		t.Fatal("expected rewrapped value to be an envelope")
+	}
+
+	if string(before.Value) != string(after.Value) {
+		t.Error("expected value ciphertext to be unchanged by rewrap")
+	}
+
+	if _, err := openEnvelope("app.secret", rewrapped, key); err == nil {
+		t.Error("expected old key to fail after rewrap")
+	}
+
+	opened, err = openEnvelope("app.secret", rewrapped, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(opened) != string(secret) {
+		t.Errorf("expected %s, but got %s", secret, opened)
+	}
+}
+
+func TestLegacyEnvelope(t *testing.T) {
+	key := generateKey()
+	newKey := generateKey()
+	secret := []byte("legacy secret")
+
+	legacy, err := encrypt(secret, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := openEnvelope("app.secret", legacy, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(opened) != string(secret) {
+		t.Errorf("expected %s, but got %s", secret, opened)
+	}
+
+	upgraded, err := rewrapEnvelope(aesGCM{}, "app.secret", legacy, key, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := parseEnvelope(upgraded); !ok {
+		t.Error("expected legacy value to be sealed into an envelope")
+	}
+
+	opened, err = openEnvelope("app.secret", upgraded, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(opened) != string(secret) {
+		t.Errorf("expected %s, but got %s", secret, opened)
+	}
+}
+
+// sealV1Envelope seals a value the way envelopes were written before additional data was added
+func sealV1Envelope(t *testing.T, plaintext, key []byte) []byte {
+	dataKey := generateKey()
+	value, err := encrypt(plaintext, dataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := encrypt(dataKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(envelope{Version: 1, KeyID: keyID(key), Alg: algAES256GCM, Key: wrapped, Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return data
+}
+
+// reloadLegacy unlocks the database again the way a database created before envelopes were bound to their
+// name is unlocked, so the values written so far are treated as legacy values
+func reloadLegacy(t *testing.T, app AppContext, key []byte) {
+	t.Helper()
+	record := mustInitRecord(t, app)
+	record.Migrated, record.LegacyRevision = false, 0
+	if err := app.putInitRecord(record, app.keys.key()); err != nil {
+		t.Fatal(err)
+	}
+
+	app.Seal()
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLegacyValues(t *testing.T) {
+	app, _ := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	v1 := sealV1Envelope(t, []byte("v1 secret"), key)
+	revision, err := app.KV.Put("app.secret", v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloadLegacy(t, app, key)
+
+	secret := &JetStreamRecord{bucket: piggyBucket, key: "app.secret"}
+	if value, err := app.getRecord(secret); err != nil || string(value) != "v1 secret" {
+		t.Fatalf("expected legacy value written before the cutoff to open but got %s: %v", value, err)
+	}
+
+	// a legacy value copied to another secret is a newer revision than the cutoff
+	if _, err := app.KV.Put("app.copy", v1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.getRecord(&JetStreamRecord{bucket: piggyBucket, key: "app.copy"}); !errors.Is(err, errLegacyFormat) {
+		t.Errorf("expected copied legacy value to be refused but got %v", err)
+	}
+	if err := app.KV.Delete("app.copy"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.Migrate(""); err != nil {
+		t.Fatal(err)
+	}
+	app.rotation.wait()
+
+	record := mustInitRecord(t, app)
+	if err := record.open(app.keys.key()); err != nil || !record.Migrated {
+		t.Fatal("expected a completed migration to mark the database migrated")
+	}
+
+	if value, err := app.getRecord(secret); err != nil || string(value) != "v1 secret" {
+		t.Errorf("expected migrated value to open but got %s: %v", value, err)
+	}
+
+	// the legacy revision is still in the history, but older formats are refused once migrated
+	if _, err := app.getRecordAt(secret, revision); !errors.Is(err, errLegacyFormat) {
+		t.Errorf("expected legacy revision to be refused after migration but got %v", err)
+	}
+}
+
+func TestMigrationStateAuthenticated(t *testing.T) {
+	app, _ := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := app.KV.Get(initKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the migration state in the clear is ignored, so it cannot reopen the database to legacy values
+	var fields map[string]any
+	if err := json.Unmarshal(entry.Value(), &fields); err != nil {
+		t.Fatal(err)
+	}
+	fields["migrated"], fields["legacy_revision"] = false, 1<<40
+	if _, err := app.KV.Put(initKey, mustJSON(t, fields)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.KV.Put("app.secret", sealV1Envelope(t, []byte("v1 secret"), key)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.getRecord(&JetStreamRecord{bucket: piggyBucket, key: "app.secret"}); !errors.Is(err, errLegacyFormat) {
+		t.Errorf("expected legacy value to be refused but got %v", err)
+	}
+
+	// a changed check value no longer opens with the database key
+	app.Seal()
+	record := mustInitRecord(t, app)
+	record.Check[len(record.Check)-1] ^= 0xff
+	if _, err := app.KV.Put(initKey, mustJSON(t, record)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err == nil {
+		t.Error("expected unlock with a changed check value to fail")
+	}
+}
+
+func TestEnvelopeBoundToName(t *testing.T) {
+	key := generateKey()
+
+	sealed, err := sealEnvelope(aesGCM{}, "prod.db_password", []byte("prod password"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := openEnvelope("dev.db_password", sealed, key); err == nil {
+		t.Error("expected envelope copied to another secret to fail")
+	}
+
+	rewrapped, err := rewrapEnvelope(aesGCM{}, "prod.db_password", sealed, key, generateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rewrapEnvelope(aesGCM{}, "dev.db_password", rewrapped, key, key); err == nil {
+		t.Error("expected rewrap under another secret name to fail")
+	}
+}
+
+func TestUpgradeV1Envelope(t *testing.T) {
+	key := generateKey()
+	secret := []byte("v1 secret")
+	v1 := sealV1Envelope(t, secret, key)
+
+	opened, err := openEnvelope("app.secret", v1, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(opened) != string(secret) {
+		t.Errorf("expected %s, but got %s", secret, opened)
+	}
+
+	upgraded, err := rewrapEnvelope(aesGCM{}, "app.secret", v1, key, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, ok := parseEnvelope(upgraded)
+	if !ok || !env.current(aesGCM{}, key) {
+		t.Fatalf("expected envelope to be upgraded to version %d", envelopeVersion)
+	}
+
+	if _, err := openEnvelope("other.secret", upgraded, key); err == nil {
+		t.Error("expected upgraded envelope to be bound to its name")
+	}
+}
@@ -60,6 +60,10 @@ func AppHandler(logger *logr.Logger, h AppHandlerFunc, app AppContext) micro.Han
 
 		app.logger = reqLogger
 
+		if app.Signer != nil {
+			r = signedRequest{Request: r, signer: app.Signer}
+		}
+
 		err := h(r, app)
 		if err == nil {
 			return
@@ -0,0 +1,232 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/CoverWhale/logr"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+const (
+	TTLHeader     = "Piggybank-TTL"
+	ExpiresHeader = "Piggybank-Expires"
+)
+
+// ExpiredEvent is published when the sweeper purges an expired secret
+type ExpiredEvent struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+// parseExpiry returns the expiry requested by the TTL or expires header of a write, nil if neither is set. The
+// TTL is a duration such as 15m and the expiry is an RFC 3339 time.
+func parseExpiry(r micro.Request, now time.Time) (*time.Time, error) {
+	ttl := r.Headers().Get(TTLHeader)
+	expires := r.Headers().Get(ExpiresHeader)
+
+	if ttl != "" && expires != "" {
+		return nil, NewClientError(fmt.Errorf("only one of ttl or expires can be set"), 400)
+	}
+
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil || d <= 0 {
+			return nil, NewClientError(fmt.Errorf("invalid ttl"), 400)
+		}
+
+		t := now.Add(d)
+		return &t, nil
+	}
+
+	if expires != "" {
+		t, err := time.Parse(time.RFC3339, expires)
+		if err != nil {
+			return nil, NewClientError(fmt.Errorf("invalid expiry"), 400)
+		}
+
+		if !t.After(now) {
+			return nil, NewClientError(fmt.Errorf("expiry must be in the future"), 400)
+		}
+
+		return &t, nil
+	}
+
+	return nil, nil
+}
+
+// expired returns true if the metadata expires the secret at the revision. An expiry only applies to the
+// revision it was written with, so a newer write is never expired by stale metadata.
+func (m SecretMetadata) expired(revision uint64, now time.Time) bool {
+	if m.Revision == revision {
+		return m.Expires != nil && !now.Before(*m.Expires)
+	}
+
+	expires, ok := m.RevisionExpires[revision]
+	return ok && !now.Before(expires)
+}
+
+// hasExpiry returns true if the latest or any earlier revision was written with an expiry
+func (m SecretMetadata) hasExpiry() bool {
+	return m.Expires != nil || len(m.RevisionExpires) > 0
+}
+
+// checkExpiry returns a 410 if the secret has expired and is waiting to be purged
+func (a *AppContext) checkExpiry(k string) error {
+	meta, _, err := a.getMetadata(k)
+	if err != nil {
+		return err
+	}
+
+	if meta.Expires == nil {
+		return nil
+	}
+
+	entry, err := a.KV.Get(k)
+	if err == nats.ErrKeyNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if meta.expired(entry.Revision(), time.Now()) {
+		return NewClientError(fmt.Errorf("secret expired"), 410)
+	}
+
+	return nil
+}
+
+// checkExpiryAt returns a 410 if the revision of the secret was written with an expiry that has passed. Expired
+// revisions stay in the history until the secret is purged, so they are refused like the latest revision.
+func (a *AppContext) checkExpiryAt(k string, revision uint64) error {
+	meta, _, err := a.getMetadata(k)
+	if err != nil {
+		return err
+	}
+
+	if meta.expired(revision, time.Now()) {
+		return NewClientError(fmt.Errorf("revision %d expired", revision), 410)
+	}
+
+	return nil
+}
+
+// fieldExpiry returns a 410 if the secret has expired, otherwise the expiry of a write that changes one field of
+// the secret. The rest of the secret is unchanged, so it keeps its current expiry unless the write sets a new one.
+func (a *AppContext) fieldExpiry(k string, expires *time.Time) (*time.Time, error) {
+	meta, _, err := a.getMetadata(k)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := a.KV.Get(k)
+	if err == nats.ErrKeyNotFound {
+		return expires, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if meta.expired(entry.Revision(), time.Now()) {
+		return nil, NewClientError(fmt.Errorf("secret expired"), 410)
+	}
+
+	if expires == nil && meta.Revision == entry.Revision() {
+		return meta.Expires, nil
+	}
+
+	return expires, nil
+}
+
+// StartExpirySweeper purges expired secrets every interval until the returned function is called. Purging
+// does not need the database key, so it runs while the database is locked. Every instance can run a sweeper.
+func (a *AppContext) StartExpirySweeper(logger *logr.Logger, interval time.Duration) (func(), error) {
+	if interval < 0 {
+		return nil, fmt.Errorf("expiry sweep interval cannot be negative")
+	}
+
+	done := make(chan struct{})
+	if interval == 0 {
+		return func() { close(done) }, nil
+	}
+
+	app := *a
+	app.logger = logger.WithContext(map[string]string{"sweeper": "expiry"})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case now := <-ticker.C:
+				app.sweepExpired(now)
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }, nil
+}
+
+// sweepExpired purges every secret that expired before now along with its metadata
+func (a *AppContext) sweepExpired(now time.Time) {
+	names, err := a.KV.Keys()
+	if err == nats.ErrNoKeysFound {
+		return
+	}
+
+	if err != nil {
+		a.logger.Errorf("error listing secrets for expiry: %v", err)
+		return
+	}
+
+	for _, name := range names {
+		if !strings.HasPrefix(name, metaKeyPrefix) {
+			continue
+		}
+
+		k := strings.TrimPrefix(name, metaKeyPrefix)
+		if err := a.purgeExpired(k, now); err != nil {
+			a.logger.Errorf("error purging expired secret %s: %v", k, err)
+		}
+	}
+}
+
+// purgeExpired purges the secret and its metadata if it has expired. Both purges are checked against the
+// revisions that were read, so a secret written again after it expired is kept. Another instance purging
+// the same secret first is not an error.
+func (a *AppContext) purgeExpired(k string, now time.Time) error {
+	meta, revision, err := a.getMetadata(k)
+	if err != nil || meta.Expires == nil || now.Before(*meta.Expires) {
+		return err
+	}
+
+	if err := a.KV.Purge(k, nats.LastRevision(meta.Revision)); err != nil {
+		if isRevisionConflict(err) {
+			return nil
+		}
+		return err
+	}
+
+	if err := a.KV.Purge(metaKeyPrefix+k, nats.LastRevision(revision)); err != nil && !isRevisionConflict(err) {
+		return err
+	}
+
+	a.logger.Infof("purged expired secret %s", k)
+
+	data, err := json.Marshal(ExpiredEvent{Key: k, Expires: *meta.Expires})
+	if err != nil {
+		return err
+	}
+	a.publishEvent("expired", data)
+
+	return nil
+}
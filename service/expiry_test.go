@@ -0,0 +1,237 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestSecretExpiry(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{Conn: nc}
+	if _, err := client.PostTTL("app.token", []byte("token"), 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.PostTTL("app.renewed", []byte("token"), 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.PostExpires("app.later", []byte("token"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := client.Get("app.token"); err != nil || value != "token" {
+		t.Errorf("expected token before expiry but got %s: %v", value, err)
+	}
+
+	// a write without a ttl removes the expiry
+	if _, err := client.Post("app.renewed", []byte("renewed")); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	if code := requestCode(t, nc, "piggybank.secrets.GET.app.token", nil); code != "410" {
+		t.Errorf("expected expired secret to return 410 but got %s", code)
+	}
+	if _, err := client.Get("app.renewed"); err != nil {
+		t.Errorf("expected renewed secret not to expire: %v", err)
+	}
+
+	app.sweepExpired(time.Now())
+
+	for _, k := range []string{"app.token", metaKeyPrefix + "app.token"} {
+		if _, err := app.KV.Get(k); err != nats.ErrKeyNotFound {
+			t.Errorf("expected %s to be purged but got %v", k, err)
+		}
+	}
+	if code := requestCode(t, nc, "piggybank.secrets.GET.app.token", nil); code != "404" {
+		t.Errorf("expected purged secret to return 404 but got %s", code)
+	}
+
+	for _, k := range []string{"app.renewed", "app.later"} {
+		if _, err := client.Get(k); err != nil {
+			t.Errorf("expected %s to be kept: %v", k, err)
+		}
+	}
+}
+
+func TestSecretExpiryHeaders(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	tt := []struct {
+		name   string
+		header nats.Header
+	}{
+		{name: "both", header: nats.Header{TTLHeader: []string{"1m"}, ExpiresHeader: []string{time.Now().Add(time.Hour).Format(time.RFC3339)}}},
+		{name: "invalid ttl", header: nats.Header{TTLHeader: []string{"soon"}}},
+		{name: "negative ttl", header: nats.Header{TTLHeader: []string{"-1m"}}},
+		{name: "past expiry", header: nats.Header{ExpiresHeader: []string{time.Now().Add(-time.Hour).Format(time.RFC3339)}}},
+	}
+
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			code := requestMsgCode(t, nc, &nats.Msg{Subject: "piggybank.secrets.POST.app.token", Data: []byte("token"), Header: v.header})
+			if code != "400" {
+				t.Errorf("expected 400 but got %s", code)
+			}
+		})
+	}
+
+	if _, err := app.KV.Get("app.token"); err != nats.ErrKeyNotFound {
+		t.Errorf("expected rejected writes not to store the secret but got %v", err)
+	}
+}
+
+func TestSecretExpiryKeepsNewerWrite(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{Conn: nc}
+	if _, err := client.PostTTL("app.token", []byte("token"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// a rotation rewraps the secret as a new revision and the expiry follows it
+	if _, err := app.Rotate(RotateRequest{CurrentKey: toBase64(key)}); err != nil {
+		t.Fatal(err)
+	}
+	app.rotation.wait()
+
+	entry, err := app.KV.Get("app.token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, _, err := app.getMetadata("app.token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Revision != entry.Revision() {
+		t.Errorf("expected expiry to follow the rewrapped revision %d but got %d", entry.Revision(), meta.Revision)
+	}
+
+	// a write that lands before its metadata is not purged by the expiry of the previous revision
+	if _, err := app.KV.Put("app.token", entry.Value()); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.purgeExpired("app.token", time.Now().Add(2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.KV.Get("app.token"); err != nil {
+		t.Errorf("expected newer write to be kept: %v", err)
+	}
+}
+
+func TestSecretExpiryRevision(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{Conn: nc}
+	expiring, err := client.PostTTL("app.token", []byte("short lived"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Post("app.token", []byte("renewed")); err != nil {
+		t.Fatal(err)
+	}
+
+	if value, err := client.GetAt("app.token", expiring); err != nil || value != "short lived" {
+		t.Errorf("expected superseded revision before its expiry but got %s: %v", value, err)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	// the expired revision is still in the history but cannot be read or restored
+	header := nats.Header{RevisionHeader: []string{strconv.FormatUint(expiring, 10)}}
+	if code := requestMsgCode(t, nc, &nats.Msg{Subject: "piggybank.secrets.GET.app.token", Header: header}); code != "410" {
+		t.Errorf("expected expired revision to return 410 but got %s", code)
+	}
+	if code := requestMsgCode(t, nc, &nats.Msg{Subject: "piggybank.secrets.ROLLBACK.app.token", Header: header}); code != "410" {
+		t.Errorf("expected rollback to an expired revision to return 410 but got %s", code)
+	}
+
+	if value, err := client.Get("app.token"); err != nil || value != "renewed" {
+		t.Errorf("expected the latest revision not to expire but got %s: %v", value, err)
+	}
+}
+
+func TestSecretExpiryDelete(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{Conn: nc}
+	expiring, err := client.PostTTL("app.token", []byte("short lived"), 100*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Post("app.kept", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	_, kept, err := client.GetRevision("app.kept")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"app.token", "app.kept"} {
+		if code := requestCode(t, nc, "piggybank.secrets.DELETE."+k, nil); code != "200" {
+			t.Fatalf("expected deleting %s to return 200 but got %s", k, code)
+		}
+	}
+
+	time.Sleep(150 * time.Millisecond)
+
+	// a deleted secret with an expiry leaves no revisions behind once its metadata is gone
+	header := nats.Header{RevisionHeader: []string{strconv.FormatUint(expiring, 10)}}
+	if code := requestMsgCode(t, nc, &nats.Msg{Subject: "piggybank.secrets.GET.app.token", Header: header}); code == "200" {
+		t.Error("expected the revision of a deleted expiring secret not to be readable")
+	}
+	if code := requestMsgCode(t, nc, &nats.Msg{Subject: "piggybank.secrets.ROLLBACK.app.token", Header: header}); code == "200" {
+		t.Error("expected the revision of a deleted expiring secret not to be restored")
+	}
+	history, err := app.KV.History("app.token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 || history[0].Operation() != nats.KeyValuePurge {
+		t.Errorf("expected only a purge marker in the history of app.token but got %d entries", len(history))
+	}
+
+	// a deleted secret without an expiry can still be restored
+	if value, err := client.GetAt("app.kept", kept); err != nil || value != "value" {
+		t.Errorf("expected the revision of a deleted secret without expiry but got %s: %v", value, err)
+	}
+}
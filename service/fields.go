@@ -0,0 +1,201 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+const (
+	FieldHeader    = "Piggybank-Field"
+	fieldSeparator = ":"
+)
+
+// secretField returns the key and the field selected by a request. A secret holding a JSON object can have a
+// single field read or written by adding the field to the key after a colon, which cannot appear in a key, such
+// as app.db:user, or by setting the field header. The field is empty when the request is for the whole secret.
+func secretField(r micro.Request) (string, string, error) {
+	k, err := secretKey(r.Subject())
+	if err != nil {
+		return "", "", err
+	}
+
+	k, field, _ := strings.Cut(k, fieldSeparator)
+	header := r.Headers().Get(FieldHeader)
+
+	if field != "" && header != "" && field != header {
+		return "", "", NewClientError(fmt.Errorf("field set in both the subject and header"), 400)
+	}
+
+	if field == "" {
+		field = header
+	}
+
+	return k, field, nil
+}
+
+// decodeFields returns the fields of a secret holding a JSON object
+func decodeFields(data []byte) (map[string]json.RawMessage, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return nil, NewClientError(fmt.Errorf("secret is not a JSON object"), 400)
+	}
+
+	return fields, nil
+}
+
+// fieldValue returns a single field of a secret holding a JSON object. String fields are returned unquoted,
+// any other value is returned as JSON.
+func fieldValue(data []byte, field string) ([]byte, error) {
+	fields, err := decodeFields(data)
+	if err != nil {
+		return nil, err
+	}
+	defer zeroFields(fields)
+
+	raw, ok := fields[field]
+	if !ok {
+		return nil, NewClientError(fmt.Errorf("field not found"), 404)
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return []byte(s), nil
+	}
+
+	return append([]byte(nil), raw...), nil
+}
+
+func zeroFields(fields map[string]json.RawMessage) {
+	for _, v := range fields {
+		zero(v)
+	}
+}
+
+// updateFields applies fn to the fields of a secret holding a JSON object and stores the result, creating the
+// secret if it does not exist. The write is checked against the revision that was read and retried if another
+// request changed the secret first, so concurrent field updates are never lost. If expected is set the update
+// only applies at that revision and is not retried. The new revision is returned.
+func (a *AppContext) updateFields(k, expected string, fn func(map[string]json.RawMessage) error) (uint64, error) {
+	var want *uint64
+	if expected != "" {
+		revision, err := strconv.ParseUint(expected, 10, 64)
+		if err != nil {
+			return 0, NewClientError(fmt.Errorf("invalid expected revision"), 400)
+		}
+		want = &revision
+	}
+
+	for i := 0; i < attemptsRetries; i++ {
+		fields, revision, err := a.getFields(k)
+		if err != nil {
+			return 0, err
+		}
+
+		if want != nil && *want != revision {
+			zeroFields(fields)
+			return 0, NewClientError(fmt.Errorf("secret is not at revision %d", *want), 409)
+		}
+
+		newRevision, err := a.putFields(k, fields, revision, fn)
+		if err == nil {
+			return newRevision, nil
+		}
+
+		if !isRevisionConflict(err) {
+			return 0, err
+		}
+
+		if want != nil {
+			return 0, NewClientError(fmt.Errorf("secret is not at revision %d", *want), 409)
+		}
+	}
+
+	return 0, NewClientError(fmt.Errorf("secret changed, try again"), 409)
+}
+
+// getFields returns the fields of the secret and the revision they were read at, no fields and 0 if the
+// secret does not exist
+func (a *AppContext) getFields(k string) (map[string]json.RawMessage, uint64, error) {
+	entry, err := a.KV.Get(k)
+	if err == nats.ErrKeyNotFound {
+		return map[string]json.RawMessage{}, 0, nil
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	decrypted, err := a.keys.open(k, entry.Revision(), entry.Value())
+	if err != nil {
+		return nil, 0, err
+	}
+	defer zero(decrypted)
+	a.keys.touch()
+
+	fields, err := decodeFields(decrypted)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return fields, entry.Revision(), nil
+}
+
+// putFields applies fn to the fields and stores them if the secret is still at the revision
+func (a *AppContext) putFields(k string, fields map[string]json.RawMessage, revision uint64, fn func(map[string]json.RawMessage) error) (uint64, error) {
+	defer zeroFields(fields)
+
+	if err := fn(fields); err != nil {
+		return 0, err
+	}
+
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return 0, err
+	}
+	defer zero(data)
+
+	a.keys.change.RLock()
+	defer a.keys.change.RUnlock()
+
+	record := JetStreamRecord{
+		bucket: piggyBucket,
+		key:    k,
+		value:  data,
+		keys:   a.keys,
+	}
+	if err := record.Encrypt(); err != nil {
+		return 0, err
+	}
+
+	return a.UpdateRecord(&record, revision)
+}
+
+// setField returns an update that sets the field to the value as a JSON string
+func setField(field string, value []byte) func(map[string]json.RawMessage) error {
+	return func(fields map[string]json.RawMessage) error {
+		encoded, err := json.Marshal(string(value))
+		if err != nil {
+			return err
+		}
+
+		fields[field] = encoded
+		return nil
+	}
+}
+
+// removeField returns an update that removes the field
+func removeField(field string) func(map[string]json.RawMessage) error {
+	return func(fields map[string]json.RawMessage) error {
+		if _, ok := fields[field]; !ok {
+			return NewClientError(fmt.Errorf("field not found"), 404)
+		}
+
+		delete(fields, field)
+		return nil
+	}
+}
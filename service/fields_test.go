@@ -0,0 +1,156 @@
+package service
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestSecretFields(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	type credentials struct {
+		User string `json:"user"`
+		Pass string `json:"pass"`
+		Port int    `json:"port"`
+	}
+
+	client := Client{Conn: nc}
+	if _, err := client.PostJSON("app.db", credentials{User: "app", Pass: "hunter2", Port: 5432}); err != nil {
+		t.Fatal(err)
+	}
+
+	user, err := client.GetField("app.db", "user")
+	if err != nil || user != "app" {
+		t.Errorf("expected app but got %s: %v", user, err)
+	}
+
+	port, err := client.GetField("app.db", "port")
+	if err != nil || port != "5432" {
+		t.Errorf("expected 5432 but got %s: %v", port, err)
+	}
+
+	if _, err := client.PostField("app.db", "pass", []byte("correct horse")); err != nil {
+		t.Fatal(err)
+	}
+
+	var creds credentials
+	if err := client.GetJSON("app.db", &creds); err != nil {
+		t.Fatal(err)
+	}
+	if creds != (credentials{User: "app", Pass: "correct horse", Port: 5432}) {
+		t.Errorf("expected only the password to change but got %+v", creds)
+	}
+
+	// the field can also be selected with a subject suffix
+	if code := requestCode(t, nc, "piggybank.secrets.GET.app.db:missing", nil); code != "404" {
+		t.Errorf("expected missing field to return 404 but got %s", code)
+	}
+
+	if _, err := client.DeleteField("app.db", "port"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetField("app.db", "port"); err == nil {
+		t.Error("expected deleted field to be removed")
+	}
+
+	if _, err := client.Post("app.plain", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	if code := requestCode(t, nc, "piggybank.secrets.GET.app.plain:user", nil); code != "400" {
+		t.Errorf("expected field of a secret that is not an object to return 400 but got %s", code)
+	}
+}
+
+func TestSecretFieldsExpiry(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{Conn: nc}
+	if _, err := client.PostTTL("app.db", []byte(`{"user":"app","pass":"hunter2"}`), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := client.Metadata("app.db")
+	if err != nil || before.Expires == nil {
+		t.Fatalf("expected the secret to expire: %v", err)
+	}
+
+	// changing one field keeps the expiry of the rest of the secret
+	if _, err := client.PostField("app.db", "pass", []byte(`"correct horse"`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.DeleteField("app.db", "user"); err != nil {
+		t.Fatal(err)
+	}
+
+	after, err := client.Metadata("app.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Expires == nil || !after.Expires.Equal(*before.Expires) {
+		t.Fatalf("expected field writes to keep the expiry %s but got %v", before.Expires, after.Expires)
+	}
+
+	// an expired secret cannot be brought back by writing a field
+	if _, err := app.updateMetadata("app.db", func(m *SecretMetadata) {
+		expired := time.Now().Add(-time.Minute)
+		m.Expires = &expired
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if code := requestMsgCode(t, nc, &nats.Msg{Subject: "piggybank.secrets.POST.app.db", Data: []byte(`"new"`), Header: nats.Header{FieldHeader: []string{"pass"}}}); code != "410" {
+		t.Errorf("expected field write to an expired secret to return 410 but got %s", code)
+	}
+	if code := requestMsgCode(t, nc, &nats.Msg{Subject: "piggybank.secrets.DELETE.app.db", Header: nats.Header{FieldHeader: []string{"pass"}}}); code != "410" {
+		t.Errorf("expected field delete of an expired secret to return 410 but got %s", code)
+	}
+}
+
+func TestSecretFieldsConcurrentUpdates(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	fields := []string{"user", "pass", "host"}
+	var wg sync.WaitGroup
+	for _, v := range fields {
+		wg.Add(1)
+		go func(field string) {
+			defer wg.Done()
+			if _, err := app.updateFields("app.db", "", setField(field, []byte(field))); err != nil {
+				t.Errorf("expected field update to succeed: %v", err)
+			}
+		}(v)
+	}
+	wg.Wait()
+
+	client := Client{Conn: nc}
+	for _, v := range fields {
+		value, err := client.GetField("app.db", v)
+		if err != nil || value != v {
+			t.Errorf("expected %s but got %s: %v", v, value, err)
+		}
+	}
+}
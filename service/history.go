@@ -0,0 +1,159 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+const (
+	SecretVersionPut    = "put"
+	SecretVersionDelete = "delete"
+	SecretVersionPurge  = "purge"
+)
+
+// SecretVersion describes one revision of a secret kept in the bucket history
+type SecretVersion struct {
+	Revision  uint64    `json:"revision"`
+	Created   time.Time `json:"created"`
+	Operation string    `json:"operation"`
+}
+
+func versionOperation(op nats.KeyValueOp) string {
+	switch op {
+	case nats.KeyValueDelete:
+		return SecretVersionDelete
+	case nats.KeyValuePurge:
+		return SecretVersionPurge
+	default:
+		return SecretVersionPut
+	}
+}
+
+// getHistory returns the versions of the secret the bucket still holds, oldest first
+func (a *AppContext) getHistory(k KV) ([]SecretVersion, error) {
+	entries, err := a.KV.History(k.Key())
+	if err == nats.ErrKeyNotFound {
+		return nil, NewClientError(fmt.Errorf("key not found"), 404)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]SecretVersion, 0, len(entries))
+	for _, v := range entries {
+		versions = append(versions, SecretVersion{
+			Revision:  v.Revision(),
+			Created:   v.Created(),
+			Operation: versionOperation(v.Operation()),
+		})
+	}
+
+	return versions, nil
+}
+
+// getRecordAt returns the secret as it was at the revision. Revisions wrapped by a key that a rotation has
+// since retired from the keyring can no longer be opened, and expired revisions return a 410.
+func (a *AppContext) getRecordAt(k KV, revision uint64) ([]byte, error) {
+	if err := a.checkExpiryAt(k.Key(), revision); err != nil {
+		return nil, err
+	}
+
+	entry, err := a.KV.GetRevision(k.Key(), revision)
+	if err == nats.ErrKeyNotFound {
+		return nil, NewClientError(fmt.Errorf("revision %d not found", revision), 404)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	decrypted, err := a.keys.open(k.Key(), entry.Revision(), entry.Value())
+	if errors.Is(err, errUnknownKey) {
+		return nil, NewClientError(fmt.Errorf("revision %d is wrapped by a retired key", revision), 410)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	a.keys.touch()
+
+	return decrypted, nil
+}
+
+// HistoryRecord lists the revisions of a secret without decrypting them
+func HistoryRecord(r micro.Request, app AppContext) error {
+	k, err := secretKey(r.Subject())
+	if err != nil {
+		return err
+	}
+
+	versions, err := app.getHistory(&JetStreamRecord{bucket: piggyBucket, key: k})
+	if err != nil {
+		return err
+	}
+
+	return r.RespondJSON(ResponseMessage{Details: fmt.Sprintf("%d versions", len(versions)), History: versions})
+}
+
+// RollbackRecord stores the value of the secret at the revision in the revision header as a new revision,
+// wrapped by the current key. If the expected revision header is set the secret is only restored if it is
+// currently at that revision. The restored secret only expires if the TTL or expires header is set.
+func RollbackRecord(r micro.Request, app AppContext) error {
+	k, err := secretKey(r.Subject())
+	if err != nil {
+		return err
+	}
+
+	target, err := strconv.ParseUint(r.Headers().Get(RevisionHeader), 10, 64)
+	if err != nil || target == 0 {
+		return NewClientError(fmt.Errorf("revision to roll back to required"), 400)
+	}
+
+	expires, err := parseExpiry(r, time.Now())
+	if err != nil {
+		return err
+	}
+
+	record := JetStreamRecord{
+		bucket: piggyBucket,
+		key:    k,
+		keys:   app.keys,
+	}
+
+	decrypted, err := app.getRecordAt(&record, target)
+	if err != nil {
+		return err
+	}
+	defer zero(decrypted)
+	record.value = decrypted
+
+	var revision uint64
+	if expected := r.Headers().Get(ExpectedRevisionHeader); expected != "" {
+		current, err := strconv.ParseUint(expected, 10, 64)
+		if err != nil {
+			return NewClientError(fmt.Errorf("invalid expected revision"), 400)
+		}
+
+		revision, err = app.updateRecord(&record, current)
+		if err != nil {
+			return err
+		}
+	} else {
+		revision, err = app.putRecord(&record)
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := app.recordWrite(k, r, revision, expires); err != nil {
+		return err
+	}
+
+	return r.RespondJSON(ResponseMessage{Details: fmt.Sprintf("rolled back to revision %d", target), Revision: revision})
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestSecretHistory(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{Conn: nc}
+	for _, v := range []string{"first", "second", "third"} {
+		if _, err := client.Post("app.password", []byte(v)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := client.History("app.password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 versions but got %d", len(versions))
+	}
+
+	first := versions[0].Revision
+	value, err := client.GetAt("app.password", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "first" {
+		t.Errorf("expected first but got %s", value)
+	}
+
+	revision, err := client.Rollback("app.password", first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if revision <= versions[2].Revision {
+		t.Errorf("expected rollback to store a new revision but got %d", revision)
+	}
+
+	value, current, err := client.GetRevision("app.password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "first" || current != revision {
+		t.Errorf("expected first at revision %d but got %s at %d", revision, value, current)
+	}
+
+	if _, err := client.GetAt("app.password", 999); err == nil {
+		t.Error("expected missing revision to fail")
+	}
+
+	// a revision of another secret is not returned
+	if _, err := client.Post("app.other", []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	versions, err = client.History("app.other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.GetAt("app.password", versions[0].Revision); err == nil {
+		t.Error("expected revision of another secret to fail")
+	}
+}
+
+func TestSecretHistoryRetiredKey(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{Conn: nc}
+	if _, err := client.Post("app.password", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.Rotate(RotateRequest{CurrentKey: toBase64(key)}); err != nil {
+		t.Fatal(err)
+	}
+	app.rotation.wait()
+
+	versions, err := client.History("app.password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("expected the rewrapped secret to add a version but got %d versions", len(versions))
+	}
+
+	code := requestMsgCode(t, nc, &nats.Msg{
+		Subject: "piggybank.secrets.GET.app.password",
+		Header:  nats.Header{RevisionHeader: []string{strconv.FormatUint(versions[0].Revision, 10)}},
+	})
+	if code != "410" {
+		t.Errorf("expected revision wrapped by a retired key to return 410 but got %s", code)
+	}
+
+	// the rewrapped version still holds the value
+	value, err := client.GetAt("app.password", versions[1].Revision)
+	if err != nil || value != "first" {
+		t.Errorf("expected first but got %s: %v", value, err)
+	}
+}
@@ -3,10 +3,10 @@ package service
 import "regexp"
 
 type JetStreamRecord struct {
-	bucket        string
-	key           string
-	value         []byte
-	encryptionKey []byte
+	bucket string
+	key    string
+	value  []byte
+	keys   *keyStore
 }
 
 // NewJSRecord returns a new JetStreamRecord
@@ -34,9 +34,9 @@ func SanitizeKey(k string) string {
 	return reg.ReplaceAllString(k, "${1}")
 }
 
-// Encrypt encrypts the value of the JetStreamRecord using the encryption key stored in the record
+// Encrypt seals the value of the JetStreamRecord in an envelope wrapped by the current key in the record's key store
 func (j *JetStreamRecord) Encrypt() error {
-	v, err := encrypt(j.value, j.encryptionKey)
+	v, err := j.keys.seal(j.key, j.value)
 	if err != nil {
 		return err
 	}
@@ -45,9 +45,10 @@ func (j *JetStreamRecord) Encrypt() error {
 	return nil
 }
 
-// Decrypt decrypts the value of the JetStreamRecord using the encryption key stored in the record
+// Decrypt opens the value of the JetStreamRecord using the keys in the record's key store. The record does not
+// know the revision it was read at, so values in older envelope formats are refused.
 func (j *JetStreamRecord) Decrypt() ([]byte, error) {
-	v, err := decrypt(j.value, j.encryptionKey)
+	v, err := j.keys.open(j.key, 0, j.value)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,447 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errKeyChanged is returned when the database key changes or is locked while a secret is being rewrapped
+var errKeyChanged = errors.New("database key changed")
+
+// errUnknownKey is returned when a value is wrapped by a key that is not in the keyring, such as one retired by a rotation
+var errUnknownKey = errors.New("no key found for key id")
+
+// errLegacyFormat is returned for a value that is not bound to its name and may have been copied from another secret
+var errLegacyFormat = NewClientError(errors.New("secret is stored in a legacy format that is no longer accepted"), 410)
+
+// keyring maps key IDs to database keys
+type keyring map[string][]byte
+
+// keyStore holds the seal state of a bank: the current database key, the previous keys that were replaced by a
+// rotation but still have secrets wrapped by them, the unseal shares submitted so far and the cipher used to seal
+// new secrets. The previous keys are stored in the init record encrypted with the current key. Keys are held in
+// locked memory and are zeroed when the database is locked. Core dumps are disabled while any key is held.
+//
+// The store is safe for concurrent use. Key bytes are only read while holding mu, and changes to the seal state
+// such as unlock, lock and rotate are serialized by change, so a key is never zeroed while it is in use. Callers
+// using the slices returned by key and previousKeys must hold change. Writes hold change for reading from sealing
+// a value until it is stored, so a key is never retired while a value wrapped by it is being written.
+//
+// The store also records when it was unlocked and when a secret was last read for the auto-lock policy, and
+// the reason it was last auto locked. Values sealed before envelopes were bound to their name are only opened at
+// or below the legacy revision, none are opened once it is 0.
+type keyStore struct {
+	change           sync.RWMutex
+	mu               sync.RWMutex
+	current          *lockedKey
+	previous         map[string]*lockedKey
+	shares           []string
+	cipher           Cipher
+	restoreCoreDumps func() error
+	unlockedAt       time.Time
+	lastRead         atomic.Int64
+	autoLock         *AutoLockEvent
+	legacyRevision   uint64
+}
+
+// newKeyStore returns a locked key store
+func newKeyStore() *keyStore {
+	return &keyStore{cipher: aesGCM{}}
+}
+
+// key returns the current database key or nil if the database is locked
+func (k *keyStore) key() []byte {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.current.bytes()
+}
+
+// currentID returns the ID of the current database key
+func (k *keyStore) currentID() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.current == nil {
+		return ""
+	}
+
+	return keyID(k.current.bytes())
+}
+
+// unlocked returns true if the store holds a database key
+func (k *keyStore) unlocked() bool {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.current != nil
+}
+
+// sealCipher returns the cipher used to seal new secrets
+func (k *keyStore) sealCipher() Cipher {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.cipher
+}
+
+// setCipher changes the cipher used to seal new secrets
+func (k *keyStore) setCipher(c Cipher) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.cipher = c
+}
+
+// set replaces every key in the store and the cipher. The passed in keys are copied into locked memory and then zeroed.
+// Replacing the keys of an unlocked store, such as after a rotation, keeps the time it was unlocked.
+func (k *keyStore) set(key []byte, previous keyring, c Cipher) {
+	k.mu.RLock()
+	unlockedAt := k.unlockedAt
+	k.mu.RUnlock()
+
+	k.wipe()
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if unlockedAt.IsZero() {
+		unlockedAt = time.Now()
+		k.lastRead.Store(unlockedAt.UnixNano())
+	}
+	k.unlockedAt = unlockedAt
+
+	if k.restoreCoreDumps == nil {
+		restore, err := disableCoreDumps()
+		if err == nil {
+			k.restoreCoreDumps = restore
+		}
+	}
+
+	k.cipher = c
+	k.current = newLockedKey(key)
+	zero(key)
+
+	k.previous = map[string]*lockedKey{}
+	for id, v := range previous {
+		k.previous[id] = newLockedKey(v)
+		zero(v)
+	}
+}
+
+// setLegacyRevision sets the last revision values in older envelope formats are opened at
+func (k *keyStore) setLegacyRevision(revision uint64) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.legacyRevision = revision
+}
+
+// checkFormat returns errLegacyFormat if the value is not bound to its name and was written after the legacy
+// revision. A revision of 0 is unknown, so older formats are refused. The caller must hold mu.
+func (k *keyStore) checkFormat(revision uint64, data []byte) error {
+	if env, ok := parseEnvelope(data); ok && env.Version >= envelopeVersion {
+		return nil
+	}
+
+	if revision == 0 || revision > k.legacyRevision {
+		return errLegacyFormat
+	}
+
+	return nil
+}
+
+// previousKeys returns the previous keys. The returned keys are zeroed when they are retired or the store is wiped.
+func (k *keyStore) previousKeys() keyring {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	previous := keyring{}
+	for id, v := range k.previous {
+		previous[id] = v.bytes()
+	}
+
+	return previous
+}
+
+// rotate replaces the current key with the new key and keeps the replaced key as a previous key
+func (k *keyStore) rotate(newKey []byte) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.previous == nil {
+		k.previous = map[string]*lockedKey{}
+	}
+
+	k.previous[keyID(k.current.bytes())] = k.current
+	k.current = newLockedKey(newKey)
+}
+
+// restore makes the previous key with the ID the current key again, undoing a rotation
+func (k *keyStore) restore(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	previous, ok := k.previous[id]
+	if !ok {
+		return
+	}
+
+	delete(k.previous, id)
+	k.current.destroy()
+	k.current = previous
+}
+
+// retire zeroes and removes the previous key with the ID
+func (k *keyStore) retire(id string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.previous[id].destroy()
+	delete(k.previous, id)
+}
+
+// wipe zeroes and removes every key, drops any submitted shares and restores core dumps
+func (k *keyStore) wipe() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.current.destroy()
+	k.current = nil
+
+	for _, v := range k.previous {
+		v.destroy()
+	}
+	k.previous = nil
+	k.shares = nil
+	k.unlockedAt = time.Time{}
+	k.autoLock = nil
+	k.legacyRevision = 0
+
+	if k.restoreCoreDumps != nil {
+		k.restoreCoreDumps()
+		k.restoreCoreDumps = nil
+	}
+}
+
+// touch records that a secret was read
+func (k *keyStore) touch() {
+	k.lastRead.Store(time.Now().UnixNano())
+}
+
+// activity returns when the store was unlocked and when a secret was last read. Both are zero if the store is locked.
+func (k *keyStore) activity() (time.Time, time.Time) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.current == nil {
+		return time.Time{}, time.Time{}
+	}
+
+	return k.unlockedAt, time.Unix(0, k.lastRead.Load())
+}
+
+// setAutoLock records why the store was auto locked. It is cleared the next time the store is unlocked or wiped.
+func (k *keyStore) setAutoLock(event *AutoLockEvent) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.autoLock = event
+}
+
+// lastAutoLock returns the reason the store was auto locked or nil if it was not
+func (k *keyStore) lastAutoLock() *AutoLockEvent {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.autoLock
+}
+
+// addShare holds a submitted unseal share and returns the number of shares now held
+func (k *keyStore) addShare(share string) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	for _, v := range k.shares {
+		if v == share {
+			return len(k.shares), NewClientError(fmt.Errorf("share already submitted"), 400)
+		}
+	}
+
+	k.shares = append(k.shares, share)
+
+	return len(k.shares), nil
+}
+
+// takeShares returns the submitted shares and removes them from the store
+func (k *keyStore) takeShares() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	shares := k.shares
+	k.shares = nil
+
+	return shares
+}
+
+// dropShares removes any submitted shares
+func (k *keyStore) dropShares() {
+	k.takeShares()
+}
+
+// shareCount returns the number of shares submitted so far
+func (k *keyStore) shareCount() int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return len(k.shares)
+}
+
+// seal seals the plaintext for the secret with the current key and cipher
+func (k *keyStore) seal(name string, plaintext []byte) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.current == nil {
+		return nil, NewClientError(fmt.Errorf("database locked"), 403)
+	}
+
+	return sealEnvelope(k.cipher, name, plaintext, k.current.bytes())
+}
+
+// keyID returns the identifier stored with every envelope wrapped by the key. It is a truncated hash
+// of the key so it can be derived from the key alone without revealing it.
+func keyID(key []byte) string {
+	sum := sha256.Sum256(append([]byte("piggybank key id:"), key...))
+	return hex.EncodeToString(sum[:8])
+}
+
+// encode encrypts the keyring with the passed in key
+func (k keyring) encode(key []byte) ([]byte, error) {
+	data, err := json.Marshal(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return encrypt(data, key)
+}
+
+// decodeKeyring decrypts a keyring that was encrypted with the passed in key
+func decodeKeyring(data, key []byte) (keyring, error) {
+	if data == nil {
+		return keyring{}, nil
+	}
+
+	decrypted, err := decrypt(data, key)
+	if err != nil {
+		return nil, err
+	}
+
+	k := keyring{}
+	if err := json.Unmarshal(decrypted, &k); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// keysFor returns the keys that may have wrapped the stored value. Envelopes carry the ID of the
+// key that wrapped them, values stored before key IDs were added are tried against every key.
+// The caller must hold mu.
+func (k *keyStore) keysFor(data []byte) ([][]byte, error) {
+	if k.current == nil {
+		return nil, NewClientError(fmt.Errorf("database locked"), 403)
+	}
+
+	env, ok := parseEnvelope(data)
+	if !ok || env.KeyID == "" {
+		candidates := [][]byte{k.current.bytes()}
+		for _, v := range k.previous {
+			candidates = append(candidates, v.bytes())
+		}
+		return candidates, nil
+	}
+
+	if env.KeyID == keyID(k.current.bytes()) {
+		return [][]byte{k.current.bytes()}, nil
+	}
+
+	key, ok := k.previous[env.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("%w %s", errUnknownKey, env.KeyID)
+	}
+
+	return [][]byte{key.bytes()}, nil
+}
+
+// open opens a stored value at the revision with whichever key in the keyring wrapped it
+func (k *keyStore) open(name string, revision uint64, data []byte) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if err := k.checkFormat(revision, data); err != nil {
+		return nil, err
+	}
+
+	candidates, err := k.keysFor(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range candidates {
+		decrypted, err := openEnvelope(name, data, key)
+		if err == nil {
+			return decrypted, nil
+		}
+		if len(candidates) == 1 {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("no key in the keyring can open the value")
+}
+
+// rewrap wraps a stored value with the current key and cipher using whichever key in the keyring wrapped it. The
+// current key must have the expected ID so a value is never wrapped by a key that replaced it during a rotation.
+// If the value is already wrapped by the current key and cipher nil is returned. Values in older formats are
+// refused the same way as open, so a copied legacy value is never sealed to the name it was copied to.
+func (k *keyStore) rewrap(name string, revision uint64, data []byte, expectedID string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.current == nil || keyID(k.current.bytes()) != expectedID {
+		return nil, errKeyChanged
+	}
+
+	env, ok := parseEnvelope(data)
+	if ok && env.current(k.cipher, k.current.bytes()) {
+		return nil, nil
+	}
+
+	if err := k.checkFormat(revision, data); err != nil {
+		return nil, err
+	}
+
+	candidates, err := k.keysFor(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range candidates {
+		rewrapped, err := rewrapEnvelope(k.cipher, name, data, key, k.current.bytes())
+		if err == nil {
+			return rewrapped, nil
+		}
+		if len(candidates) == 1 {
+			return nil, err
+		}
+	}
+
+	return nil, fmt.Errorf("no key in the keyring can open the value")
+}
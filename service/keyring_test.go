@@ -0,0 +1,156 @@
+package service
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/CoverWhale/logr"
+	"github.com/nats-io/nats.go"
+)
+
+func TestConcurrentSealState(t *testing.T) {
+	app := newTestApp(t)
+
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	vals := map[string]string{}
+	for i := 0; i < 20; i++ {
+		vals[fmt.Sprintf("app.secret%d", i)] = fmt.Sprintf("value %d", i)
+	}
+
+	store := func(name, value string) error {
+		return app.addRecord(&JetStreamRecord{bucket: piggyBucket, key: name, value: []byte(value), keys: app.keys})
+	}
+
+	for k, v := range vals {
+		if err := store(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	current := key
+	currentKey := func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		return toBase64(current)
+	}
+
+	var wg sync.WaitGroup
+	run := func(f func(i int)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				f(i)
+			}
+		}()
+	}
+
+	for k, v := range vals {
+		k, v := k, v
+		run(func(int) {
+			decrypted, err := app.getRecord(&JetStreamRecord{bucket: piggyBucket, key: k})
+			if err == nil && string(decrypted) != v {
+				t.Errorf("expected %s but got %s", v, decrypted)
+			}
+		})
+		run(func(int) {
+			store(k, v)
+		})
+	}
+
+	run(func(i int) {
+		if i%2 == 0 {
+			app.Seal()
+			return
+		}
+		kv := JetStreamRecord{bucket: piggyBucket, key: initKey, value: []byte(currentKey())}
+		app.Unlock(&kv)
+	})
+
+	run(func(int) {
+		newKey, err := app.Rotate(RotateRequest{CurrentKey: currentKey()})
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		current = newKey
+		mu.Unlock()
+	})
+
+	wg.Wait()
+
+	if !app.keys.unlocked() {
+		kv := JetStreamRecord{bucket: piggyBucket, key: initKey, value: []byte(currentKey())}
+		if err := app.Unlock(&kv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app.rotation.wait()
+
+	for k, v := range vals {
+		decrypted, err := app.getRecord(&JetStreamRecord{bucket: piggyBucket, key: k})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(decrypted) != v {
+			t.Errorf("expected %s but got %s", v, decrypted)
+		}
+	}
+}
+
+func TestIndependentBanks(t *testing.T) {
+	server := NewServer(t)
+	defer shutdownJSServerAndRemoveStorage(t, server)
+
+	nc, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	banks := make([]AppContext, 2)
+	for i := range banks {
+		kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: fmt.Sprintf("bank%d", i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		banks[i] = NewAppContext(kv)
+		banks[i].logger = logr.NewLogger()
+
+		key, err := banks[i].initialize(InitRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := banks[i].unlock(unlockRequest(t, toBase64(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	banks[0].Seal()
+
+	if banks[0].keys.unlocked() {
+		t.Error("expected first bank to be locked")
+	}
+
+	if !banks[1].keys.unlocked() {
+		t.Error("expected locking the first bank to leave the second unlocked")
+	}
+}
@@ -0,0 +1,117 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// ListRequest holds the options for listing secrets. Secrets are listed in sorted order, After is the last
+// key of the previous page and Limit is the page size. If Metadata is set the metadata of each secret is
+// returned with its key.
+type ListRequest struct {
+	After    string `json:"after,omitempty"`
+	Limit    int    `json:"limit,omitempty"`
+	Metadata bool   `json:"metadata,omitempty"`
+}
+
+// SecretListing is a secret returned by a list request. It never holds the value.
+type SecretListing struct {
+	Key      string          `json:"key"`
+	Metadata *SecretMetadata `json:"metadata,omitempty"`
+}
+
+// listPrefix returns the prefix from a list request subject, empty when the subject has none
+func listPrefix(subject string) string {
+	prefix := strings.TrimPrefix(subject, fmt.Sprintf("%s.%s", secretSubject, LIST))
+	return strings.TrimPrefix(prefix, ".")
+}
+
+// inPrefix returns true if the key is the prefix or under it. Prefixes match whole subject tokens, so
+// permission to list app does not list app2.
+func inPrefix(k, prefix string) bool {
+	return prefix == "" || k == prefix || strings.HasPrefix(k, prefix+".")
+}
+
+// listSecrets returns a page of the secret keys under the prefix and the key to pass as After for the next
+// page, empty on the last page. System records are never listed.
+func (a *AppContext) listSecrets(prefix string, req ListRequest) ([]SecretListing, string, error) {
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+
+	if limit > maxListLimit {
+		return nil, "", NewClientError(fmt.Errorf("limit cannot be more than %d", maxListLimit), 400)
+	}
+
+	names, err := a.KV.Keys()
+	if err != nil && err != nats.ErrNoKeysFound {
+		return nil, "", err
+	}
+
+	keys := make([]string, 0, len(names))
+	for _, k := range names {
+		if systemKey(k) || !inPrefix(k, prefix) || k <= req.After {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var next string
+	if len(keys) > limit {
+		keys = keys[:limit]
+		next = keys[limit-1]
+	}
+
+	secrets := make([]SecretListing, 0, len(keys))
+	for _, k := range keys {
+		listing := SecretListing{Key: k}
+		if req.Metadata {
+			meta, revision, err := a.getMetadata(k)
+			if err != nil {
+				return nil, "", err
+			}
+
+			if revision != 0 {
+				listing.Metadata = &meta
+			}
+		}
+		secrets = append(secrets, listing)
+	}
+
+	return secrets, next, nil
+}
+
+// ListRecords returns the keys of the secrets under the prefix in the subject without their values. The
+// request body is an optional ListRequest.
+func ListRecords(r micro.Request, app AppContext) error {
+	prefix := listPrefix(r.Subject())
+	if systemKey(prefix + ".") {
+		return NewClientError(fmt.Errorf("keys starting with %s are reserved", systemPrefix), 400)
+	}
+
+	var req ListRequest
+	if len(r.Data()) > 0 {
+		if err := json.Unmarshal(r.Data(), &req); err != nil {
+			return NewClientError(fmt.Errorf("bad request"), 400)
+		}
+	}
+
+	secrets, next, err := app.listSecrets(prefix, req)
+	if err != nil {
+		return err
+	}
+
+	return r.RespondJSON(ResponseMessage{Details: fmt.Sprintf("%d secrets", len(secrets)), Secrets: secrets, Next: next})
+}
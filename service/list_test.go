@@ -0,0 +1,74 @@
+package service
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestListSecrets(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{Conn: nc}
+	for _, k := range []string{"app.a", "app.b", "app.c", "app2.a", "other.a"} {
+		if _, err := client.Post(k, []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	description := "first"
+	if _, err := client.UpdateMetadata("app.a", MetadataUpdate{Description: &description}); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys []string
+	var after string
+	for {
+		secrets, next, err := client.List("app", ListRequest{After: after, Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, v := range secrets {
+			if v.Metadata != nil {
+				t.Errorf("expected no metadata unless requested but got %+v", v.Metadata)
+			}
+			keys = append(keys, v.Key)
+		}
+
+		if next == "" {
+			break
+		}
+		after = next
+	}
+
+	if !slices.Equal(keys, []string{"app.a", "app.b", "app.c"}) {
+		t.Errorf("expected the keys under app but got %v", keys)
+	}
+
+	secrets, _, err := client.List("app", ListRequest{Metadata: true, Limit: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 1 || secrets[0].Metadata == nil || secrets[0].Metadata.Description != description {
+		t.Errorf("expected metadata with the listing but got %+v", secrets)
+	}
+
+	secrets, _, err = client.List("", ListRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secrets) != 5 {
+		t.Errorf("expected every secret and no system records but got %+v", secrets)
+	}
+
+	if code := requestCode(t, nc, "piggybank.secrets.LIST._piggybank", nil); code != "400" {
+		t.Errorf("expected listing the system prefix to return 400 but got %s", code)
+	}
+}
@@ -0,0 +1,354 @@
+package service
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+const (
+	attemptsKey      = systemPrefix + "attempts"
+	attemptsRetries  = 3
+	lockoutBaseDelay = time.Second
+	lockoutMaxDelay  = 5 * time.Minute
+	// attemptClaimWindow is how long a claimed attempt holds off other attempts by the caller if the instance
+	// checking it never gives the claim back
+	attemptClaimWindow = 30 * time.Second
+	requestInfoHeader  = "Nats-Request-Info"
+	unidentifiedCaller = "unidentified"
+)
+
+// LockoutPolicy limits how fast the unseal material can be guessed. Failures are counted for each caller. After each
+// failed unlock, rotate or rekey the caller's next attempt is delayed, starting at one second and doubling up to five
+// minutes. Once MaxFailures attempts in a row from the caller have failed its attempts are rejected for the Window.
+// A MaxFailures of 0 disables the lockout but keeps the delay.
+//
+// Failures from every caller are also counted together, and once GlobalMaxFailures have failed every attempt from
+// any caller is rejected for the Window. This is a last resort against a caller that keeps changing its identity,
+// at the cost that enough failures from anyone lock out the operators as well. A GlobalMaxFailures of 0 disables it.
+type LockoutPolicy struct {
+	MaxFailures       int
+	GlobalMaxFailures int
+	Window            time.Duration
+}
+
+// DefaultLockoutPolicy returns the policy used when none is configured
+func DefaultLockoutPolicy() LockoutPolicy {
+	return LockoutPolicy{MaxFailures: 10, GlobalMaxFailures: 100, Window: time.Hour}
+}
+
+// Validate checks the policy values
+func (p LockoutPolicy) Validate() error {
+	if p.MaxFailures < 0 || p.GlobalMaxFailures < 0 || p.Window < 0 {
+		return fmt.Errorf("lockout failures and window cannot be negative")
+	}
+
+	return nil
+}
+
+// FailedAttempts counts the failed attempts since the last successful one. It is stored in the KV bucket so the
+// count is shared by every instance and survives a restart. Each caller has its own count under the attempts key,
+// and the count for every caller is stored at the attempts key itself.
+type FailedAttempts struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"last_failure"`
+	LockedUntil time.Time `json:"locked_until"`
+	// Attempted is when an attempt that is still being checked was claimed, zero if there is none
+	Attempted time.Time `json:"attempted"`
+}
+
+// retryAt returns the earliest time another attempt is allowed
+func (f FailedAttempts) retryAt() time.Time {
+	if f.Failures == 0 {
+		return time.Time{}
+	}
+
+	delay := lockoutMaxDelay
+	if f.Failures <= 10 {
+		delay = min(lockoutBaseDelay<<(f.Failures-1), lockoutMaxDelay)
+	}
+
+	retry := f.LastFailure.Add(delay)
+	if f.LockedUntil.After(retry) {
+		return f.LockedUntil
+	}
+
+	return retry
+}
+
+// AttemptHandler wraps handlers that check unseal material. Requests are rejected with a 429 until the delay after
+// the caller's last failure has passed, and requests rejected with a 401 are counted as failed attempts. Handlers
+// reset the count once the material is verified.
+func AttemptHandler(a AppHandlerFunc) AppHandlerFunc {
+	return func(r micro.Request, app AppContext) error {
+		claim, err := app.claimAttempt(attemptCaller(r))
+		if err != nil {
+			return err
+		}
+
+		err = a(r, app)
+		if isAuthFailure(err) {
+			app.recordFailure(attemptCaller(r), callerIdentity(r), err)
+		} else {
+			app.releaseAttempt(attemptCaller(r), claim)
+		}
+
+		return err
+	}
+}
+
+// isAuthFailure returns true if the error rejected the unseal material
+func isAuthFailure(err error) bool {
+	var ce ClientError
+	return errors.As(err, &ce) && ce.Code == 401
+}
+
+// requestInfo is the client info the server adds to requests imported from another account
+type requestInfo struct {
+	Account string `json:"acc"`
+	User    string `json:"user"`
+	Name    string `json:"name"`
+	Host    string `json:"host"`
+}
+
+// parseRequestInfo returns the client info header of the request, false if it is missing
+func parseRequestInfo(r micro.Request) (requestInfo, bool) {
+	var info requestInfo
+	header := r.Headers().Get(requestInfoHeader)
+	if header == "" || json.Unmarshal([]byte(header), &info) != nil {
+		return requestInfo{}, false
+	}
+
+	return info, true
+}
+
+// callerIdentity describes who sent the request. The server adds the client info header to requests
+// imported from another account, otherwise only the reply subject identifies the caller.
+func callerIdentity(r micro.Request) string {
+	caller := []string{fmt.Sprintf("reply=%s", r.Reply())}
+
+	if info, ok := parseRequestInfo(r); ok {
+		caller = append(caller, fmt.Sprintf("account=%s user=%s name=%s host=%s", info.Account, info.User, info.Name, info.Host))
+	}
+
+	return strings.Join(caller, " ")
+}
+
+// attemptCaller returns the caller failed attempts are counted for. The server adds the account and user to requests
+// imported from another account. Callers in the service account can set the header themselves and requests without
+// it all share one count, so only the global count bounds guessing from them.
+func attemptCaller(r micro.Request) string {
+	info, ok := parseRequestInfo(r)
+	if !ok {
+		return unidentifiedCaller
+	}
+
+	return fmt.Sprintf("account=%s user=%s", info.Account, info.User)
+}
+
+// attemptsCallerKey returns the key the failed attempts of the caller are stored under
+func attemptsCallerKey(caller string) string {
+	sum := sha256.Sum256([]byte(caller))
+	return fmt.Sprintf("%s.%s", attemptsKey, hex.EncodeToString(sum[:16]))
+}
+
+// getFailedAttempts returns the failed attempts stored at the key and the revision they are stored at, 0 if there are none
+func (a *AppContext) getFailedAttempts(k string) (FailedAttempts, uint64, error) {
+	entry, err := a.KV.Get(k)
+	if err == nats.ErrKeyNotFound {
+		return FailedAttempts{}, 0, nil
+	}
+
+	if err != nil {
+		return FailedAttempts{}, 0, err
+	}
+
+	var attempts FailedAttempts
+	if err := json.Unmarshal(entry.Value(), &attempts); err != nil {
+		return FailedAttempts{}, 0, err
+	}
+
+	return attempts, entry.Revision(), nil
+}
+
+// claimAttempt returns a 429 if the caller has to wait before trying again or every caller is locked out.
+// Otherwise the attempt is claimed by writing the time to the caller's record with the revision that was read,
+// so of parallel attempts on any instance only one is checked and the others are rejected until it is counted
+// or given back. It returns the revision of the claim.
+func (a *AppContext) claimAttempt(caller string) (uint64, error) {
+	global, _, err := a.getFailedAttempts(attemptsKey)
+	if err != nil {
+		return 0, err
+	}
+
+	if now := time.Now(); now.Before(global.LockedUntil) {
+		return 0, NewClientError(fmt.Errorf("too many failed attempts from every caller, locked out until %s", global.LockedUntil.Format(time.RFC3339)), 429)
+	}
+
+	k := attemptsCallerKey(caller)
+	for i := 0; i < attemptsRetries; i++ {
+		attempts, revision, err := a.getFailedAttempts(k)
+		if err != nil {
+			return 0, err
+		}
+
+		now := time.Now()
+		if now.Before(attempts.LockedUntil) {
+			return 0, NewClientError(fmt.Errorf("too many failed attempts, locked out until %s", attempts.LockedUntil.Format(time.RFC3339)), 429)
+		}
+
+		if retry := attempts.retryAt(); now.Before(retry) {
+			return 0, NewClientError(fmt.Errorf("too many failed attempts, retry in %s", retry.Sub(now).Round(time.Second)), 429)
+		}
+
+		if now.Before(attempts.Attempted.Add(attemptClaimWindow)) {
+			return 0, NewClientError(fmt.Errorf("another attempt is being checked, try again"), 429)
+		}
+
+		attempts.Attempted = now
+		data, err := json.Marshal(attempts)
+		if err != nil {
+			return 0, err
+		}
+
+		var claim uint64
+		if revision == 0 {
+			claim, err = a.KV.Create(k, data)
+		} else {
+			claim, err = a.KV.Update(k, data, revision)
+		}
+
+		if isRevisionConflict(err) {
+			continue
+		}
+
+		return claim, err
+	}
+
+	return 0, NewClientError(fmt.Errorf("another attempt is being checked, try again"), 429)
+}
+
+// releaseAttempt gives back a claimed attempt that did not fail. The record is only changed if nothing was
+// written since the claim, a success resets it anyway.
+func (a *AppContext) releaseAttempt(caller string, claim uint64) {
+	k := attemptsCallerKey(caller)
+	attempts, revision, err := a.getFailedAttempts(k)
+	if err != nil || revision != claim {
+		return
+	}
+
+	if attempts.Failures == 0 {
+		err = a.KV.Delete(k, nats.LastRevision(claim))
+	} else {
+		attempts.Attempted = time.Time{}
+		var data []byte
+		data, err = json.Marshal(attempts)
+		if err == nil {
+			_, err = a.KV.Update(k, data, claim)
+		}
+	}
+
+	if err != nil && !isRevisionConflict(err) {
+		a.logger.Errorf("error releasing attempt: %v", err)
+	}
+}
+
+// recordFailure counts a failed attempt for the caller and for every caller, and starts the lockout window once
+// either policy maximum is reached. The identity describes the request in the log.
+func (a *AppContext) recordFailure(caller, identity string, cause error) {
+	attempts, lockout, err := a.countFailure(attemptsCallerKey(caller), a.Lockout.MaxFailures)
+	if err != nil {
+		a.logger.Errorf("failed attempt from %s not counted: %v", identity, err)
+		return
+	}
+
+	a.logger.Errorf("failed attempt %d from %s: %v", attempts.Failures, identity, cause)
+	if lockout {
+		a.logger.Errorf("%s locked out until %s", caller, attempts.LockedUntil.Format(time.RFC3339))
+		a.publishLockout(attempts)
+	}
+
+	global, lockout, err := a.countFailure(attemptsKey, a.Lockout.GlobalMaxFailures)
+	if err != nil {
+		a.logger.Errorf("failed attempt from %s not counted for every caller: %v", identity, err)
+		return
+	}
+
+	if lockout {
+		a.logger.Errorf("%d failed attempts from every caller, every caller locked out until %s", global.Failures, global.LockedUntil.Format(time.RFC3339))
+		a.publishLockout(global)
+	}
+}
+
+// countFailure adds a failed attempt to the count stored at the key. It returns true if the count reached the maximum
+// and the lockout window was started.
+func (a *AppContext) countFailure(k string, max int) (FailedAttempts, bool, error) {
+	for i := 0; i < attemptsRetries; i++ {
+		attempts, revision, err := a.getFailedAttempts(k)
+		if err != nil {
+			return FailedAttempts{}, false, err
+		}
+
+		attempts.Failures++
+		attempts.LastFailure = time.Now()
+		attempts.Attempted = time.Time{}
+		lockout := max > 0 && attempts.Failures >= max
+		if lockout {
+			attempts.LockedUntil = attempts.LastFailure.Add(a.Lockout.Window)
+		}
+
+		data, err := json.Marshal(attempts)
+		if err != nil {
+			return FailedAttempts{}, false, err
+		}
+
+		if revision == 0 {
+			_, err = a.KV.Create(k, data)
+		} else {
+			_, err = a.KV.Update(k, data, revision)
+		}
+
+		if isRevisionConflict(err) {
+			continue
+		}
+
+		if err != nil {
+			return FailedAttempts{}, false, err
+		}
+
+		return attempts, lockout, nil
+	}
+
+	return FailedAttempts{}, false, fmt.Errorf("failed attempts kept changing")
+}
+
+func (a *AppContext) publishLockout(attempts FailedAttempts) {
+	data, err := json.Marshal(attempts)
+	if err != nil {
+		a.logger.Errorf("error encoding failed attempts: %v", err)
+		return
+	}
+
+	a.publishEvent("lockout", data)
+}
+
+// resetAttempts clears the failed attempts of the caller and of every caller after the unseal material was verified
+func (a *AppContext) resetAttempts(caller string) {
+	for _, k := range []string{attemptsCallerKey(caller), attemptsKey} {
+		_, revision, err := a.getFailedAttempts(k)
+		if err != nil || revision == 0 {
+			continue
+		}
+
+		if err := a.KV.Delete(k); err != nil {
+			a.logger.Errorf("error resetting failed attempts: %v", err)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+func TestUnlockBackoff(t *testing.T) {
+	app, nc := newTestService(t)
+
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock := SubjectVerbs[DBUnlock]
+	if code := requestCode(t, nc, unlock, unlockRequest(t, toBase64(generateKey()))); code != "401" {
+		t.Fatalf("expected wrong key to be rejected with 401 but got %s", code)
+	}
+
+	// the correct key is rejected until the delay after the failure has passed
+	if code := requestCode(t, nc, unlock, unlockRequest(t, toBase64(key))); code != "429" {
+		t.Fatalf("expected attempt during backoff to be rejected with 429 but got %s", code)
+	}
+
+	status, err := app.status(unidentifiedCaller)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.FailedAttempts != 1 || status.RetryAt == nil {
+		t.Errorf("expected status to report 1 failed attempt but got %d", status.FailedAttempts)
+	}
+
+	time.Sleep(lockoutBaseDelay)
+	if code := requestCode(t, nc, unlock, unlockRequest(t, toBase64(key))); code != "200" {
+		t.Fatalf("expected unlock after backoff to succeed but got %s", code)
+	}
+
+	attempts, _, err := app.getFailedAttempts(attemptsCallerKey(unidentifiedCaller))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attempts.Failures != 0 {
+		t.Errorf("expected failed attempts to be reset after unlock but got %d", attempts.Failures)
+	}
+}
+
+func TestLockout(t *testing.T) {
+	app := newTestApp(t)
+	app.Lockout = LockoutPolicy{MaxFailures: 3, Window: time.Hour}
+
+	for i := 0; i < app.Lockout.MaxFailures; i++ {
+		app.recordFailure("attacker", "test", NewClientError(fmt.Errorf("invalid database key"), 401))
+	}
+
+	attempts, _, err := app.getFailedAttempts(attemptsCallerKey("attacker"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attempts.Failures != 3 || attempts.LockedUntil.Before(time.Now().Add(59*time.Minute)) {
+		t.Fatalf("expected lockout for the window after 3 failures but got %+v", attempts)
+	}
+
+	var ce ClientError
+	if _, err := app.claimAttempt("attacker"); !errors.As(err, &ce) || ce.Code != 429 {
+		t.Errorf("expected 429 during lockout but got %v", err)
+	}
+
+	// another caller is not delayed by the failures
+	if _, err := app.claimAttempt("operator"); err != nil {
+		t.Errorf("expected another caller to be allowed during the lockout but got %v", err)
+	}
+
+	app.resetAttempts("attacker")
+	if _, err := app.claimAttempt("attacker"); err != nil {
+		t.Errorf("expected attempts to be allowed after reset but got %v", err)
+	}
+}
+
+func TestGlobalLockout(t *testing.T) {
+	app := newTestApp(t)
+	app.Lockout = LockoutPolicy{MaxFailures: 3, GlobalMaxFailures: 4, Window: time.Hour}
+	if _, err := app.initialize(InitRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a caller that changes its identity for every attempt is only stopped by the global count
+	for i := 0; i < app.Lockout.GlobalMaxFailures; i++ {
+		app.recordFailure(fmt.Sprintf("caller%d", i), "test", NewClientError(fmt.Errorf("invalid database key"), 401))
+	}
+
+	var ce ClientError
+	if _, err := app.claimAttempt("operator"); !errors.As(err, &ce) || ce.Code != 429 {
+		t.Errorf("expected every caller to be locked out after the global maximum but got %v", err)
+	}
+
+	status, err := app.status("operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.RetryAt == nil || status.RetryAt.Before(time.Now().Add(59*time.Minute)) {
+		t.Errorf("expected status to report the global lockout but got %v", status.RetryAt)
+	}
+}
+
+func TestParallelAttempts(t *testing.T) {
+	app, nc := newTestService(t)
+	if _, err := app.initialize(InitRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// guesses sent at the same time are not all checked before the first failure is counted
+	var wg sync.WaitGroup
+	codes := make(chan string, 10)
+	for i := 0; i < cap(codes); i++ {
+		data := unlockRequest(t, toBase64(generateKey()))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			msg, err := nc.Request(SubjectVerbs[DBUnlock], data, time.Second)
+			if err != nil {
+				codes <- err.Error()
+				return
+			}
+			codes <- msg.Header.Get(micro.ErrorCodeHeader)
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	checked := 0
+	for code := range codes {
+		if code == "401" {
+			checked++
+		}
+	}
+
+	if checked != 1 {
+		t.Errorf("expected exactly one parallel guess to be checked but %d were", checked)
+	}
+
+	attempts, _, err := app.getFailedAttempts(attemptsCallerKey(unidentifiedCaller))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attempts.Failures != checked {
+		t.Errorf("expected every checked guess to be counted but got %d failures", attempts.Failures)
+	}
+}
+
+func TestReleaseAttempt(t *testing.T) {
+	app := newTestApp(t)
+
+	claim, err := app.claimAttempt("operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ce ClientError
+	if _, err := app.claimAttempt("operator"); !errors.As(err, &ce) || ce.Code != 429 {
+		t.Errorf("expected a second attempt to wait for the claimed one but got %v", err)
+	}
+
+	// an attempt that did not fail, such as an accepted share, lets the next one through at once
+	app.releaseAttempt("operator", claim)
+	if _, err := app.claimAttempt("operator"); err != nil {
+		t.Errorf("expected attempt after release to be allowed but got %v", err)
+	}
+}
+
+func TestAttemptCaller(t *testing.T) {
+	app, nc := newTestService(t)
+	if _, err := app.initialize(InitRequest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	unlock := func(info string) string {
+		msg := nats.NewMsg(SubjectVerbs[DBUnlock])
+		msg.Data = unlockRequest(t, toBase64(generateKey()))
+		if info != "" {
+			msg.Header.Set(requestInfoHeader, info)
+		}
+
+		return requestMsgCode(t, nc, msg)
+	}
+
+	if code := unlock(`{"acc":"APP1","user":"UA"}`); code != "401" {
+		t.Fatalf("expected wrong key to be rejected with 401 but got %s", code)
+	}
+
+	if code := unlock(`{"acc":"APP1","user":"UA"}`); code != "429" {
+		t.Errorf("expected the same caller to be delayed but got %s", code)
+	}
+
+	if code := unlock(`{"acc":"APP2","user":"UB"}`); code != "401" {
+		t.Errorf("expected another caller to be checked but got %s", code)
+	}
+
+	if code := unlock(""); code != "401" {
+		t.Errorf("expected an unidentified caller to be checked but got %s", code)
+	}
+}
+
+func TestRetryAt(t *testing.T) {
+	last := time.Now()
+	tt := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{failures: 1, expected: time.Second},
+		{failures: 4, expected: 8 * time.Second},
+		{failures: 12, expected: lockoutMaxDelay},
+		{failures: 100, expected: lockoutMaxDelay},
+	}
+
+	for _, v := range tt {
+		retry := FailedAttempts{Failures: v.failures, LastFailure: last}.retryAt()
+		if retry.Sub(last) != v.expected {
+			t.Errorf("expected delay of %s after %d failures but got %s", v.expected, v.failures, retry.Sub(last))
+		}
+	}
+}
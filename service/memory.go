@@ -0,0 +1,57 @@
+package service
+
+import (
+	"os"
+)
+
+// lockedKey holds key material in its own page of memory that is locked into RAM where the platform allows it,
+// so the key is never written to swap. The key is zeroed when it is destroyed. The memory stays owned by the
+// Go runtime, so a slice of the key that outlives it reads zeros instead of faulting.
+type lockedKey struct {
+	page   []byte
+	key    []byte
+	locked bool
+}
+
+// newLockedKey copies the key into locked memory
+func newLockedKey(key []byte) *lockedKey {
+	// each key gets a full page so unlocking one key never unlocks another key sharing the page
+	page := make([]byte, max(os.Getpagesize(), len(key)))
+	l := &lockedKey{
+		page:   page,
+		key:    page[:len(key):len(key)],
+		locked: mlock(page) == nil,
+	}
+	copy(l.key, key)
+
+	return l
+}
+
+// bytes returns the key. The returned slice is zeroed when the key is destroyed.
+func (l *lockedKey) bytes() []byte {
+	if l == nil {
+		return nil
+	}
+
+	return l.key
+}
+
+// destroy zeroes the key and unlocks its memory
+func (l *lockedKey) destroy() {
+	if l == nil {
+		return
+	}
+
+	zero(l.page)
+	if l.locked {
+		munlock(l.page)
+		l.locked = false
+	}
+}
+
+// zero overwrites b with zeros
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
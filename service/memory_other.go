@@ -0,0 +1,19 @@
+//go:build !unix
+
+package service
+
+import "errors"
+
+var errMemoryProtection = errors.New("memory protection is not supported on this platform")
+
+func mlock(b []byte) error {
+	return errMemoryProtection
+}
+
+func munlock(b []byte) error {
+	return errMemoryProtection
+}
+
+func disableCoreDumps() (func() error, error) {
+	return nil, errMemoryProtection
+}
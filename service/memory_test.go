@@ -0,0 +1,76 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestLockedKey(t *testing.T) {
+	key := generateKey()
+	l := newLockedKey(key)
+
+	if !bytes.Equal(l.bytes(), key) {
+		t.Fatal("expected locked key to hold a copy of the key")
+	}
+
+	view := l.bytes()
+	l.destroy()
+
+	if !bytes.Equal(view, make([]byte, len(key))) {
+		t.Error("expected key to be zeroed when destroyed")
+	}
+}
+
+func TestKeyStoreWipe(t *testing.T) {
+	store := newKeyStore()
+	key, previous := generateKey(), generateKey()
+	keyCopy := append([]byte{}, key...)
+
+	store.set(key, keyring{keyID(previous): append([]byte{}, previous...)}, aesGCM{})
+	if !bytes.Equal(key, make([]byte, len(key))) {
+		t.Error("expected the passed in key to be zeroed")
+	}
+
+	if !bytes.Equal(store.key(), keyCopy) {
+		t.Fatal("expected store to hold the key")
+	}
+
+	current := store.key()
+	old, ok := store.previousKeys()[keyID(previous)]
+	if !ok || !bytes.Equal(old, previous) {
+		t.Fatal("expected store to hold the previous key")
+	}
+
+	store.wipe()
+
+	if store.unlocked() || len(store.previousKeys()) != 0 {
+		t.Error("expected store to be empty after wipe")
+	}
+
+	if !bytes.Equal(current, make([]byte, len(current))) || !bytes.Equal(old, make([]byte, len(old))) {
+		t.Error("expected keys to be zeroed after wipe")
+	}
+}
+
+func TestKeyStoreRotate(t *testing.T) {
+	store := newKeyStore()
+	key := generateKey()
+	oldID := keyID(key)
+	store.set(append([]byte{}, key...), nil, aesGCM{})
+	defer store.wipe()
+
+	newKey := generateKey()
+	store.rotate(newKey)
+	if !bytes.Equal(store.key(), newKey) {
+		t.Fatal("expected new key to be current")
+	}
+
+	if _, ok := store.previousKeys()[oldID]; !ok {
+		t.Fatal("expected old key to be kept as a previous key")
+	}
+
+	store.restore(oldID)
+	if !bytes.Equal(store.key(), key) || len(store.previousKeys()) != 0 {
+		t.Error("expected restore to undo the rotation")
+	}
+}
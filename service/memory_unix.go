@@ -0,0 +1,32 @@
+//go:build unix
+
+package service
+
+import "golang.org/x/sys/unix"
+
+// mlock locks b into RAM so it is not swapped to disk
+func mlock(b []byte) error {
+	return unix.Mlock(b)
+}
+
+// munlock allows b to be swapped again
+func munlock(b []byte) error {
+	return unix.Munlock(b)
+}
+
+// disableCoreDumps sets the core file size limit to zero so keys held in memory are not written to a core dump.
+// The returned function restores the previous limit.
+func disableCoreDumps() (func() error, error) {
+	var previous unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_CORE, &previous); err != nil {
+		return nil, err
+	}
+
+	if err := unix.Setrlimit(unix.RLIMIT_CORE, &unix.Rlimit{Cur: 0, Max: previous.Max}); err != nil {
+		return nil, err
+	}
+
+	return func() error {
+		return unix.Setrlimit(unix.RLIMIT_CORE, &previous)
+	}, nil
+}
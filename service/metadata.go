@@ -0,0 +1,256 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+const metaKeyPrefix = systemPrefix + "meta."
+
+// SecretMetadata describes a secret without holding its value. It is stored in cleartext next to the secret
+// so it can be read without decrypting anything. Created, Updated and UpdatedBy are set by the service when
+// the secret is written, the other fields are set by clients with the META verb.
+type SecretMetadata struct {
+	Created     time.Time         `json:"created"`
+	Updated     time.Time         `json:"updated"`
+	UpdatedBy   string            `json:"updated_by,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Owner       string            `json:"owner,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	// Revision is the revision of the secret the service fields describe
+	Revision uint64 `json:"revision,omitempty"`
+	// Expires is when the secret at Revision expires and is purged
+	Expires *time.Time `json:"expires,omitempty"`
+	// RevisionExpires holds the expiry of earlier revisions that were written with one, so they cannot be read
+	// from the history once expired. Only as many revisions as a bucket can keep are tracked.
+	RevisionExpires map[uint64]time.Time `json:"revision_expires,omitempty"`
+}
+
+// supersede keeps the expiry of the current revision before the metadata moves to a newer revision
+func (m *SecretMetadata) supersede() {
+	if m.Expires == nil || m.Revision == 0 {
+		return
+	}
+
+	if m.RevisionExpires == nil {
+		m.RevisionExpires = map[uint64]time.Time{}
+	}
+	m.RevisionExpires[m.Revision] = *m.Expires
+
+	for len(m.RevisionExpires) > nats.KeyValueMaxHistory {
+		oldest := m.Revision
+		for revision := range m.RevisionExpires {
+			oldest = min(oldest, revision)
+		}
+		delete(m.RevisionExpires, oldest)
+	}
+}
+
+// MetadataUpdate holds the metadata fields a client sets. Fields that are nil are left unchanged, and an
+// empty Labels map removes every label.
+type MetadataUpdate struct {
+	Description *string           `json:"description,omitempty"`
+	Owner       *string           `json:"owner,omitempty"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// apply sets the fields in the update on the metadata
+func (u MetadataUpdate) apply(m *SecretMetadata) {
+	if u.Description != nil {
+		m.Description = *u.Description
+	}
+
+	if u.Owner != nil {
+		m.Owner = *u.Owner
+	}
+
+	if u.Labels != nil {
+		m.Labels = u.Labels
+		if len(u.Labels) == 0 {
+			m.Labels = nil
+		}
+	}
+}
+
+// writerIdentity returns who wrote a secret. The server adds the client info header to requests imported from
+// another account, otherwise the inbox prefix of the reply subject is used, which names the app when it sets a
+// custom inbox prefix.
+func writerIdentity(r micro.Request) string {
+	if info, ok := parseRequestInfo(r); ok {
+		return fmt.Sprintf("account=%s user=%s", info.Account, info.User)
+	}
+
+	reply := r.Reply()
+	if i := strings.LastIndex(reply, "."); i > 0 {
+		reply = reply[:i]
+	}
+
+	return fmt.Sprintf("inbox=%s", reply)
+}
+
+// getMetadata returns the metadata of the secret and the revision it is stored at, 0 if there is none
+func (a *AppContext) getMetadata(k string) (SecretMetadata, uint64, error) {
+	entry, err := a.KV.Get(metaKeyPrefix + k)
+	if err == nats.ErrKeyNotFound {
+		return SecretMetadata{}, 0, nil
+	}
+
+	if err != nil {
+		return SecretMetadata{}, 0, err
+	}
+
+	var meta SecretMetadata
+	if err := json.Unmarshal(entry.Value(), &meta); err != nil {
+		return SecretMetadata{}, 0, err
+	}
+
+	return meta, entry.Revision(), nil
+}
+
+// updateMetadata applies fn to the metadata of the secret and stores it. The write is checked against the
+// revision that was read and retried if another request changed the metadata first.
+func (a *AppContext) updateMetadata(k string, fn func(*SecretMetadata)) (SecretMetadata, error) {
+	for i := 0; i < attemptsRetries; i++ {
+		meta, revision, err := a.getMetadata(k)
+		if err != nil {
+			return SecretMetadata{}, err
+		}
+
+		fn(&meta)
+
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return SecretMetadata{}, err
+		}
+
+		if revision == 0 {
+			_, err = a.KV.Create(metaKeyPrefix+k, data)
+		} else {
+			_, err = a.KV.Update(metaKeyPrefix+k, data, revision)
+		}
+
+		if isRevisionConflict(err) {
+			continue
+		}
+
+		return meta, err
+	}
+
+	return SecretMetadata{}, NewClientError(fmt.Errorf("metadata changed, try again"), 409)
+}
+
+// recordWrite sets the updated time, last writer, revision and expiry of a secret that was just stored, and the
+// created time if it is new. A nil expiry removes any expiry set by an earlier write. The secret is stored first,
+// so if the metadata cannot be written a revision that should expire is deleted again rather than left without its
+// expiry. Otherwise the error says the secret was stored.
+func (a *AppContext) recordWrite(k string, r micro.Request, revision uint64, expires *time.Time) error {
+	now := time.Now()
+	writer := writerIdentity(r)
+
+	_, err := a.updateMetadata(k, func(m *SecretMetadata) {
+		if m.Created.IsZero() {
+			m.Created = now
+		}
+		m.Updated = now
+		m.UpdatedBy = writer
+		if m.Revision != revision {
+			m.supersede()
+		}
+		m.Revision = revision
+		m.Expires = expires
+	})
+
+	if err == nil {
+		return nil
+	}
+
+	a.logger.Errorf("error recording write of %s at revision %d: %v", k, revision, err)
+	if expires == nil {
+		return NewClientError(fmt.Errorf("secret stored at revision %d but its metadata was not updated", revision), 500)
+	}
+
+	if err := a.KV.Delete(k, nats.LastRevision(revision)); err != nil {
+		a.logger.Errorf("error removing %s at revision %d without its expiry: %v", k, revision, err)
+		return NewClientError(fmt.Errorf("secret stored at revision %d without its expiry and could not be removed", revision), 500)
+	}
+
+	return NewClientError(fmt.Errorf("secret not stored, its expiry could not be recorded"), 500)
+}
+
+// followRewrap moves the metadata of a secret to the revision written when it was rewrapped, so an expiry set
+// on the old revision still applies. Secrets without metadata are left alone.
+func (a *AppContext) followRewrap(k string, from, to uint64) error {
+	for i := 0; i < attemptsRetries; i++ {
+		meta, revision, err := a.getMetadata(k)
+		if err != nil || revision == 0 || meta.Revision != from {
+			return err
+		}
+
+		meta.supersede()
+		meta.Revision = to
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+
+		_, err = a.KV.Update(metaKeyPrefix+k, data, revision)
+		if !isRevisionConflict(err) {
+			return err
+		}
+	}
+
+	return fmt.Errorf("metadata for %s kept changing", k)
+}
+
+// deleteMetadata removes the metadata of a deleted secret
+func (a *AppContext) deleteMetadata(k string) {
+	if err := a.KV.Delete(metaKeyPrefix + k); err != nil {
+		a.logger.Errorf("error deleting metadata for %s: %v", k, err)
+	}
+}
+
+// MetaRecord returns the metadata of a secret. If the request has a body it is a MetadataUpdate that is applied
+// first. The secret value is never decrypted.
+func MetaRecord(r micro.Request, app AppContext) error {
+	k, err := secretKey(r.Subject())
+	if err != nil {
+		return err
+	}
+
+	entry, err := app.KV.Get(k)
+	if err == nats.ErrKeyNotFound {
+		return NewClientError(fmt.Errorf("key not found"), 404)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var meta SecretMetadata
+	if len(r.Data()) == 0 {
+		meta, _, err = app.getMetadata(k)
+	} else {
+		var update MetadataUpdate
+		if err := json.Unmarshal(r.Data(), &update); err != nil {
+			return NewClientError(fmt.Errorf("bad request"), 400)
+		}
+
+		meta, err = app.updateMetadata(k, update.apply)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// secrets written before metadata was kept only have the time of their latest revision
+	if meta.Updated.IsZero() {
+		meta.Updated = entry.Created()
+	}
+
+	return r.RespondJSON(ResponseMessage{Details: "secret metadata", Metadata: &meta})
+}
@@ -0,0 +1,108 @@
+package service
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestSecretMetadata(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{Conn: nc}
+	if _, err := client.Post("app.password", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := client.Metadata("app.password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Created.IsZero() || !meta.Created.Equal(meta.Updated) || meta.UpdatedBy == "" {
+		t.Errorf("expected created, updated and updated by to be set but got %+v", meta)
+	}
+	created := meta.Created
+
+	description := "database password"
+	meta, err = client.UpdateMetadata("app.password", MetadataUpdate{Description: &description, Labels: map[string]string{"env": "prod"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Description != description || meta.Labels["env"] != "prod" {
+		t.Errorf("expected description and labels to be set but got %+v", meta)
+	}
+
+	if _, err := client.Post("app.password", []byte("second")); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err = client.Metadata("app.password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !meta.Created.Equal(created) || !meta.Updated.After(created) || meta.Description != description {
+		t.Errorf("expected a write to only change the updated time but got %+v", meta)
+	}
+
+	owner := "payments"
+	meta, err = client.UpdateMetadata("app.password", MetadataUpdate{Owner: &owner, Labels: map[string]string{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Owner != owner || meta.Description != description || meta.Labels != nil {
+		t.Errorf("expected owner to be set and labels removed but got %+v", meta)
+	}
+
+	// metadata is readable while the value cannot be decrypted
+	app.Seal()
+	if _, err := client.Metadata("app.password"); err != nil {
+		t.Errorf("expected metadata to be readable while locked: %v", err)
+	}
+
+	if _, err := client.Metadata("app.missing"); err == nil {
+		t.Error("expected metadata of a missing secret to fail")
+	}
+}
+
+func TestRecordWriteFailure(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	// metadata that cannot be read makes every metadata write fail
+	for _, k := range []string{"app.token", "app.plain"} {
+		if _, err := app.KV.Put(metaKeyPrefix+k, []byte("not json")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	client := Client{Conn: nc}
+	if _, err := client.PostTTL("app.token", []byte("token"), time.Hour); err == nil {
+		t.Error("expected write to fail when its expiry cannot be recorded")
+	}
+	if _, err := app.KV.Get("app.token"); err != nats.ErrKeyNotFound {
+		t.Errorf("expected a secret whose expiry was not recorded to be removed but got %v", err)
+	}
+
+	_, err = client.Post("app.plain", []byte("value"))
+	if err == nil || !strings.Contains(err.Error(), "secret stored at revision") {
+		t.Errorf("expected error to say the secret was stored but got %v", err)
+	}
+	if _, err := app.KV.Get("app.plain"); err != nil {
+		t.Errorf("expected secret without an expiry to be kept: %v", err)
+	}
+}
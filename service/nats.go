@@ -3,36 +3,102 @@ package service
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/CoverWhale/logr"
 	"github.com/nats-io/nats.go"
 	"github.com/nats-io/nats.go/micro"
+	"github.com/nats-io/nkeys"
 )
 
 var (
-	databaseKey []byte
 	piggyBucket = "piggybank"
 )
 
+// AppContext holds everything the handlers of a bank need. The seal state is shared by every copy of the
+// AppContext, so it must be created with NewAppContext.
+//
+// AdminKeys holds the nkey public keys allowed to sign requests to the administrative endpoints. If Signer is
+// set every response is signed with it. ClusterKey signs the messages instances send each other and must be
+// the same on every instance.
 type AppContext struct {
-	KV     nats.KeyValue
-	logger *logr.Logger
+	KV         nats.KeyValue
+	Conn       *nats.Conn
+	Provider   KeyProvider
+	Lockout    LockoutPolicy
+	AdminKeys  []string
+	Signer     nkeys.KeyPair
+	ClusterKey nkeys.KeyPair
+	logger     *logr.Logger
+	keys       *keyStore
+	rotation   *rotationJob
+	member     *clusterMember
+}
+
+// NewAppContext returns an AppContext for the bank stored in kv. The bank starts locked.
+func NewAppContext(kv nats.KeyValue) AppContext {
+	return AppContext{
+		KV:       kv,
+		Lockout:  DefaultLockoutPolicy(),
+		keys:     newKeyStore(),
+		rotation: &rotationJob{},
+		member:   newClusterMember(),
+	}
 }
 
 // ResponseMessage holds a response to the caller
 type ResponseMessage struct {
-	Details string `json:"details,omitempty"`
+	Details  string   `json:"details,omitempty"`
+	Shares   []string `json:"shares,omitempty"`
+	Revision uint64   `json:"revision,omitempty"`
+	Valid    bool     `json:"valid,omitempty"`
+	// History holds the versions of a secret, oldest first
+	History []SecretVersion `json:"history,omitempty"`
+	// Metadata describes a secret without its value
+	Metadata *SecretMetadata `json:"metadata,omitempty"`
+	// Secrets holds a page of a secret listing and Next the key to list after for the next page
+	Secrets []SecretListing `json:"secrets,omitempty"`
+	Next    string          `json:"next,omitempty"`
+}
+
+// StatusMessage holds the current state of the database
+type StatusMessage struct {
+	Details   string `json:"details,omitempty"`
+	Locked    bool   `json:"locked"`
+	Threshold int    `json:"threshold,omitempty"`
+	Progress  int    `json:"progress,omitempty"`
+	// UnlockedAt is when this instance was unlocked
+	UnlockedAt *time.Time `json:"unlocked_at,omitempty"`
+	// AutoLock holds the reason this instance was last auto locked while it is still locked
+	AutoLock *AutoLockEvent `json:"auto_lock,omitempty"`
+	// FailedAttempts is the number of failed unlock, rotate or rekey attempts from the caller since its last successful one
+	FailedAttempts int `json:"failed_attempts,omitempty"`
+	// RetryAt is the earliest time the caller is allowed another attempt after a failure or lockout
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+	// Instances holds the seal state of every instance of the service when more than one is running
+	Instances []InstanceStatus `json:"instances,omitempty"`
+}
+
+// MigrateRequest holds the options for migrating secrets. If Algorithm is set every secret is sealed with that cipher.
+// The unseal material is only needed when the request is not signed by an admin key.
+type MigrateRequest struct {
+	RotateRequest
+	Algorithm string `json:"algorithm,omitempty"`
 }
 
+// RotateRequest holds the unseal material proving the caller holds the database key. It is also sent
+// to lock the database without an admin signature.
 type RotateRequest struct {
-	CurrentKey string `json:"current_key"`
+	CurrentKey    string   `json:"current_key"`
+	CurrentShares []string `json:"current_shares,omitempty"`
+	Passphrase    string   `json:"passphrase,omitempty"`
 }
 
 // SecretHandler wraps any secret handlers to check if database is currently locked
 func SecretHandler(a AppHandlerFunc) AppHandlerFunc {
 	return func(r micro.Request, app AppContext) error {
-		if databaseKey == nil {
+		if !app.keys.unlocked() {
 			return NewClientError(fmt.Errorf("database locked"), 403)
 		}
 		return a(r, app)
@@ -40,53 +106,132 @@ func SecretHandler(a AppHandlerFunc) AppHandlerFunc {
 
 }
 
+// Seal locks the database, zeroing every key held in memory and dropping any submitted unseal shares
+func (a *AppContext) Seal() {
+	a.sealWith(nil)
+}
+
+// sealWith locks the database like Seal and records the auto-lock that caused it, if any
+func (a *AppContext) sealWith(event *AutoLockEvent) {
+	a.keys.change.Lock()
+	defer a.keys.change.Unlock()
+
+	a.keys.wipe()
+	a.keys.setAutoLock(event)
+}
+
+// Lock locks every instance. The request must be signed by an admin key or carry the current unseal material,
+// which is subject to the same backoff as unlock.
 func Lock(r micro.Request, app AppContext) error {
-	databaseKey = nil
+	if err := app.verifyAuthority(r); err != nil {
+		return err
+	}
+
+	app.Seal()
+	app.broadcastLock(nil)
 	return r.RespondJSON(ResponseMessage{Details: "database locked"})
 }
 
+// Initialize creates the database key. Once admin keys are configured the request must be signed by one of them.
 func Initialize(r micro.Request, app AppContext) error {
+	var initReq InitRequest
+
+	signed, err := app.verifyAdmin(r)
+	if err != nil {
+		return err
+	}
+
+	if !signed && len(app.AdminKeys) > 0 {
+		return NewClientError(fmt.Errorf("admin signature required"), 401)
+	}
+
+	if len(r.Data()) > 0 {
+		if err := json.Unmarshal(r.Data(), &initReq); err != nil {
+			return NewClientError(fmt.Errorf("bad request"), 400)
+		}
+	}
+
 	app.logger.Info("initializing database")
-	data, err := app.initialize()
+	data, err := app.initialize(initReq)
+	if err != nil {
+		return err
+
+	}
+
+	record, err := app.getInitRecord()
 	if err != nil {
 		return err
+	}
 
+	resp, err := keyResponse(data, record, "database initialized")
+	if err != nil {
+		return err
 	}
-	return r.RespondJSON(ResponseMessage{Details: toBase64(data)})
+
+	return r.RespondJSON(resp)
 }
 
+// RotateKey replaces the database key. The unseal material in the request proves the caller's authority, an
+// admin signature is checked if one is sent.
 func RotateKey(r micro.Request, app AppContext) error {
 	var rotateReq RotateRequest
 
+	if _, err := app.verifyAdmin(r); err != nil {
+		return err
+	}
+
 	if err := json.Unmarshal(r.Data(), &rotateReq); err != nil {
 		return NewClientError(fmt.Errorf("bad request"), 400)
 	}
 
-	if rotateReq.CurrentKey == "" {
-		return NewClientError(fmt.Errorf("current db key required"), 400)
+	app.logger.Info("rotating encryption key")
+	data, err := app.Rotate(rotateReq)
+	if err != nil {
+		return err
 	}
+	app.resetAttempts(attemptCaller(r))
 
-	app.logger.Info("rotating encryption key")
-	data, err := app.Rotate(rotateReq.CurrentKey)
+	record, err := app.getInitRecord()
+	if err != nil {
+		return err
+	}
+
+	app.syncKey()
+
+	resp, err := keyResponse(data, record, "database key rotated")
 	if err != nil {
 		return err
 	}
 
-	return r.RespondJSON(ResponseMessage{Details: toBase64(data)})
+	return r.RespondJSON(resp)
 }
 
 func Unlock(r micro.Request, app AppContext) error {
 	var unlocked bool
 	kv := JetStreamRecord{
 		bucket: piggyBucket,
-		key:    "init",
+		key:    initKey,
 	}
-	if databaseKey != nil {
+	if app.keys.unlocked() {
 		unlocked = true
 	}
 
+	// another instance may still be locked after a restart, so the request is passed on to the locked instances
 	if unlocked {
-		return NewClientError(fmt.Errorf("database already unlocked"), 400)
+		peers := app.peers()
+		locked := 0
+		for _, v := range peers {
+			if v.Locked {
+				locked++
+			}
+		}
+
+		if locked == 0 {
+			return NewClientError(fmt.Errorf("database already unlocked"), 400)
+		}
+
+		app.forward(peers, clusterUnlock, r.Data())
+		return r.RespondJSON(ResponseMessage{Details: fmt.Sprintf("database already unlocked, unlock forwarded to %d locked instances", locked)})
 	}
 
 	_, err := app.GetRecord(&kv)
@@ -99,59 +244,348 @@ func Unlock(r micro.Request, app AppContext) error {
 	}
 
 	app.logger.Info("unlocking database")
-	if err := app.unlock(r.Data()); err != nil {
+	remaining, err := app.unlock(r.Data())
+	if err != nil {
 		return err
 	}
+	app.forwardUnlock(r.Data())
+
+	if remaining > 0 {
+		return r.RespondJSON(ResponseMessage{Details: fmt.Sprintf("unseal share accepted, %d more required", remaining)})
+	}
+	app.resetAttempts(attemptCaller(r))
 
 	return r.RespondJSON(ResponseMessage{Details: "database successfully unlocked"})
 }
 
-// Wrap Status in secret handler so it will catch locked requests
+// MigrateRecords upgrades stored secrets to the latest envelope format. Like Lock the request must be signed by an
+// admin key or carry the current unseal material.
+func MigrateRecords(r micro.Request, app AppContext) error {
+	var migrateReq MigrateRequest
+
+	if err := app.verifyAuthority(r); err != nil {
+		return err
+	}
+
+	if len(r.Data()) > 0 {
+		if err := json.Unmarshal(r.Data(), &migrateReq); err != nil {
+			return NewClientError(fmt.Errorf("bad request"), 400)
+		}
+	}
+
+	app.logger.Info("migrating secrets")
+	if err := app.Migrate(migrateReq.Algorithm); err != nil {
+		return err
+	}
+	app.syncKey()
+
+	return r.RespondJSON(ResponseMessage{Details: "migration started"})
+}
+
+// RekeyDatabase replaces the unseal material and returns the new key or shares
+func RekeyDatabase(r micro.Request, app AppContext) error {
+	var rekeyReq RekeyRequest
+
+	if err := json.Unmarshal(r.Data(), &rekeyReq); err != nil {
+		return NewClientError(fmt.Errorf("bad request"), 400)
+	}
+
+	app.logger.Info("rekeying database")
+	unsealKey, record, err := app.Rekey(rekeyReq)
+	if err != nil {
+		return err
+	}
+	app.resetAttempts(attemptCaller(r))
+
+	if record.KDF != nil {
+		return r.RespondJSON(ResponseMessage{Details: "database rekeyed, unlock with the new passphrase"})
+	}
+
+	resp, err := keyResponse(unsealKey, initRecord{Shares: record.Shares, Threshold: record.Threshold}, "database rekeyed")
+	if err != nil {
+		return err
+	}
+
+	return r.RespondJSON(resp)
+}
+
+// RotateStatus returns the checkpoint of the current or last key rotation
+func RotateStatus(r micro.Request, app AppContext) error {
+	status, err := app.getRotationStatus()
+	if err == nats.ErrKeyNotFound {
+		return NewClientError(fmt.Errorf("no key rotation found"), 404)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return r.RespondJSON(status)
+}
+
+// Status returns whether the database is locked. If the database key is split into shares the
+// number of shares submitted towards unlocking is included.
 func Status(r micro.Request, app AppContext) error {
-	return r.RespondJSON(ResponseMessage{Details: "database unlocked"})
+	status, err := app.status(attemptCaller(r))
+	if err != nil {
+		return err
+	}
+
+	return r.RespondJSON(status)
+}
+
+// status returns the seal state of the database and the failed attempts of the caller. When more than one instance of
+// the service is running the state of every instance is included, and the database is only reported unlocked if every
+// instance is unlocked.
+func (a *AppContext) status(caller string) (StatusMessage, error) {
+	status := StatusMessage{Details: "database unlocked"}
+
+	if unlockedAt, _ := a.keys.activity(); !unlockedAt.IsZero() {
+		status.UnlockedAt = &unlockedAt
+	}
+
+	if !a.keys.unlocked() {
+		status = StatusMessage{
+			Details:  "database locked",
+			Locked:   true,
+			AutoLock: a.keys.lastAutoLock(),
+		}
+
+		if status.AutoLock != nil {
+			status.Details = fmt.Sprintf("database auto locked, %s", status.AutoLock.Details)
+		}
+
+		record, err := a.getInitRecord()
+		if err != nil && err != nats.ErrKeyNotFound {
+			return StatusMessage{}, err
+		}
+
+		if err == nats.ErrKeyNotFound {
+			status.Details = "database not initialized"
+			return status, nil
+		}
+
+		if record.sharded() {
+			status.Threshold = record.Threshold
+			status.Progress = a.keys.shareCount()
+			status.Details = fmt.Sprintf("%s, %d of %d unseal shares submitted", status.Details, status.Progress, status.Threshold)
+		}
+	}
+
+	attempts, _, err := a.getFailedAttempts(attemptsCallerKey(caller))
+	if err != nil {
+		return StatusMessage{}, err
+	}
+
+	global, _, err := a.getFailedAttempts(attemptsKey)
+	if err != nil {
+		return StatusMessage{}, err
+	}
+
+	if attempts.Failures > 0 {
+		retry := attempts.retryAt()
+		status.FailedAttempts = attempts.Failures
+		status.RetryAt = &retry
+	}
+
+	if global.LockedUntil.After(time.Now()) && (status.RetryAt == nil || global.LockedUntil.After(*status.RetryAt)) {
+		status.RetryAt = &global.LockedUntil
+	}
+
+	instances := a.clusterStatus()
+	if len(instances) == 1 {
+		return status, nil
+	}
+
+	unlocked := 0
+	for i := range instances {
+		instances[i].PublicKey = nil
+		if !instances[i].Locked {
+			unlocked++
+		}
+	}
+
+	status.Instances = instances
+	status.Locked = unlocked < len(instances)
+	status.Details = fmt.Sprintf("%s, unlocked on %d of %d instances", status.Details, unlocked, len(instances))
+
+	return status, nil
 }
 
+// GetRecord returns a secret, or the version at the revision in the revision header. If the request selects a
+// field only that field of the JSON object is returned. An expired secret returns a 410 until it is purged. The
+// response is sealed to the recipient key header if the client sent one.
 func GetRecord(r micro.Request, app AppContext) error {
+	k, field, err := secretField(r)
+	if err != nil {
+		return err
+	}
+
+	if err := app.checkExpiry(k); err != nil {
+		return err
+	}
+
 	record := JetStreamRecord{
 		bucket: piggyBucket,
-		key:    SanitizeKey(r.Subject()),
+		key:    k,
+	}
+
+	var decrypted []byte
+	var revision uint64
+	if header := r.Headers().Get(RevisionHeader); header != "" {
+		revision, err = strconv.ParseUint(header, 10, 64)
+		if err != nil || revision == 0 {
+			return NewClientError(fmt.Errorf("invalid revision"), 400)
+		}
+
+		decrypted, err = app.getRecordAt(&record, revision)
+	} else {
+		decrypted, revision, err = app.getRecordRevision(&record)
 	}
-	decrypted, err := app.getRecord(&record, databaseKey)
+
 	if err != nil {
 		return err
 	}
+	defer zero(decrypted)
+
+	if field == "" {
+		return respondSealed(r, ResponseMessage{Details: string(decrypted), Revision: revision})
+	}
 
-	return r.RespondJSON(ResponseMessage{Details: string(decrypted)})
+	value, err := fieldValue(decrypted, field)
+	if err != nil {
+		return err
+	}
+	defer zero(value)
+
+	return respondSealed(r, ResponseMessage{Details: string(value), Revision: revision})
 }
 
+// AddRecord stores a secret. If the expected revision header is set the secret is only stored if it is
+// currently at that revision, otherwise a 409 is returned. A revision of 0 requires that the secret does not exist.
+// The TTL or expires header sets when the secret expires. If the request selects a field the body is stored as
+// that field of the secret's JSON object, leaving the other fields and the expiry as they are unless a new expiry is set.
 func AddRecord(r micro.Request, app AppContext) error {
+	k, field, err := secretField(r)
+	if err != nil {
+		return err
+	}
+
+	expires, err := parseExpiry(r, time.Now())
+	if err != nil {
+		return err
+	}
+
 	record := JetStreamRecord{
-		bucket:        piggyBucket,
-		key:           SanitizeKey(r.Subject()),
-		value:         r.Data(),
-		encryptionKey: databaseKey,
+		bucket: piggyBucket,
+		key:    k,
+		value:  r.Data(),
+		keys:   app.keys,
+	}
+
+	var newRevision uint64
+	expected := r.Headers().Get(ExpectedRevisionHeader)
+	switch {
+	case field != "":
+		expires, err = app.fieldExpiry(k, expires)
+		if err != nil {
+			return err
+		}
+
+		newRevision, err = app.updateFields(k, expected, setField(field, r.Data()))
+	case expected != "":
+		revision, perr := strconv.ParseUint(expected, 10, 64)
+		if perr != nil {
+			return NewClientError(fmt.Errorf("invalid expected revision"), 400)
+		}
+
+		newRevision, err = app.updateRecord(&record, revision)
+	default:
+		newRevision, err = app.putRecord(&record)
+	}
+
+	if err != nil {
+		return err
 	}
 
-	if err := app.addRecord(&record); err != nil {
+	if err := app.recordWrite(k, r, newRevision, expires); err != nil {
 		return err
 	}
 
-	return r.RespondJSON(ResponseMessage{Details: "successfully stored secret"})
+	return r.RespondJSON(ResponseMessage{Details: "successfully stored secret", Revision: newRevision})
 }
 
+// DeleteRecord deletes a secret and its metadata. If the request selects a field only that field is removed
+// from the secret's JSON object, and the secret keeps its expiry unless the TTL or expires header is set.
 func DeleteRecord(r micro.Request, app AppContext) error {
+	k, field, err := secretField(r)
+	if err != nil {
+		return err
+	}
+
+	if field != "" {
+		expires, err := parseExpiry(r, time.Now())
+		if err != nil {
+			return err
+		}
+
+		expires, err = app.fieldExpiry(k, expires)
+		if err != nil {
+			return err
+		}
+
+		revision, err := app.updateFields(k, r.Headers().Get(ExpectedRevisionHeader), removeField(field))
+		if err != nil {
+			return err
+		}
+
+		if err := app.recordWrite(k, r, revision, expires); err != nil {
+			return err
+		}
+
+		return r.RespondJSON(ResponseMessage{Details: "successfully deleted field", Revision: revision})
+	}
+
+	meta, _, err := app.getMetadata(k)
+	if err != nil {
+		return err
+	}
+
+	// the revisions of an expiring secret would outlive the metadata that expires them, so its history is purged
+	if meta.hasExpiry() {
+		if err := app.KV.Purge(k); err != nil {
+			return err
+		}
+		app.deleteMetadata(k)
+
+		return r.RespondJSON(ResponseMessage{Details: "successfully deleted secret"})
+	}
+
 	record := JetStreamRecord{
 		bucket: piggyBucket,
-		key:    SanitizeKey(r.Subject()),
+		key:    k,
 	}
 	if err := app.deleteRecord(&record); err != nil {
 		return err
 	}
+	app.deleteMetadata(k)
 
 	return r.RespondJSON(ResponseMessage{Details: "successfully deleted secret"})
 
 }
 
+// publishEvent publishes an event for other services to consume. Events are best effort and
+// are skipped if the app has no NATS connection.
+func (a *AppContext) publishEvent(event string, data []byte) {
+	if a.Conn == nil {
+		return
+	}
+
+	if err := a.Conn.Publish(fmt.Sprintf("%s.%s", eventSubject, event), data); err != nil {
+		a.logger.Errorf("error publishing %s event: %v", event, err)
+	}
+}
+
 func WatchForConfig(logger *logr.Logger, js nats.JetStreamContext) {
 	kv, err := js.KeyValue("configs")
 	if err != nil {
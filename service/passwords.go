@@ -3,10 +3,20 @@ package service
 import (
 	"crypto/rand"
 	"encoding/base64"
+	"fmt"
 	"io"
 	"log"
 
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	kdfScrypt           = "scrypt"
+	minPassphraseLength = 8
+	maxScryptN          = 1 << 20
+	maxScryptR          = 16
+	maxScryptP          = 4
 )
 
 type Password struct {
@@ -15,7 +25,74 @@ type Password struct {
 }
 
 type DatabaseKey struct {
-	DBKey string `json:"database_key"`
+	DBKey      string `json:"database_key"`
+	Passphrase string `json:"passphrase,omitempty"`
+}
+
+// kdfParams holds the parameters used to derive a key from a passphrase. They are stored in the
+// init record so the parameters can be raised for new databases without breaking existing ones.
+type kdfParams struct {
+	Name string `json:"name"`
+	Salt []byte `json:"salt"`
+	N    int    `json:"n"`
+	R    int    `json:"r"`
+	P    int    `json:"p"`
+}
+
+// newKDFParams returns scrypt parameters with a new random salt
+func newKDFParams() kdfParams {
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		panic(err)
+	}
+
+	return kdfParams{
+		Name: kdfScrypt,
+		Salt: salt,
+		N:    1 << 15,
+		R:    8,
+		P:    1,
+	}
+}
+
+// validate checks the parameters are within the bounds the service derives keys with. The parameters are read
+// from the bucket, so anyone able to write to it could otherwise make every unlock exhaust memory and CPU.
+func (k kdfParams) validate() error {
+	if k.Name != kdfScrypt {
+		return fmt.Errorf("unsupported kdf %s", k.Name)
+	}
+
+	if k.N < 2 || k.N > maxScryptN || k.N&(k.N-1) != 0 {
+		return fmt.Errorf("scrypt N must be a power of 2 no larger than %d", maxScryptN)
+	}
+
+	if k.R < 1 || k.R > maxScryptR {
+		return fmt.Errorf("scrypt r must be between 1 and %d", maxScryptR)
+	}
+
+	if k.P < 1 || k.P > maxScryptP {
+		return fmt.Errorf("scrypt p must be between 1 and %d", maxScryptP)
+	}
+
+	return nil
+}
+
+// derive returns the 32 byte key for the passphrase
+func (k kdfParams) derive(passphrase string) ([]byte, error) {
+	if err := k.validate(); err != nil {
+		return nil, err
+	}
+
+	return scrypt.Key([]byte(passphrase), k.Salt, k.N, k.R, k.P, 32)
+}
+
+// validatePassphrase checks the passphrase meets the minimum length
+func validatePassphrase(passphrase string) error {
+	if len(passphrase) < minPassphraseLength {
+		return NewClientError(fmt.Errorf("passphrase must be at least %d characters", minPassphraseLength), 400)
+	}
+
+	return nil
 }
 
 // NewPassword returns a pointer to a new password.
@@ -1,6 +1,8 @@
 package service
 
 import (
+	"encoding/json"
+	"errors"
 	"testing"
 )
 
@@ -23,3 +25,103 @@ func TestGeneratePass(t *testing.T) {
 	}
 
 }
+
+func TestPassphraseUnlock(t *testing.T) {
+	app := newTestApp(t)
+
+	passphrase := "correct horse battery staple"
+	key, err := app.initialize(InitRequest{Passphrase: passphrase})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	record := mustInitRecord(t, app)
+	if record.KDF == nil || record.KDF.Name != kdfScrypt || len(record.KDF.Salt) == 0 {
+		t.Fatalf("expected scrypt parameters in init record but got %+v", record.KDF)
+	}
+
+	passphraseRequest := func(passphrase string) []byte {
+		data, err := json.Marshal(DatabaseKey{Passphrase: passphrase})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	_, err = app.unlock(passphraseRequest("wrong passphrase"))
+	var clientErr ClientError
+	if !errors.As(err, &clientErr) || clientErr.Code != 401 {
+		t.Fatalf("expected 401 for wrong passphrase but got %v", err)
+	}
+
+	if _, err := app.unlock(passphraseRequest(passphrase)); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(app.keys.key()) != string(key) {
+		t.Fatal("expected passphrase to unlock the database key")
+	}
+
+	if _, err := app.Rotate(RotateRequest{CurrentKey: toBase64(key)}); err == nil {
+		t.Error("expected rotate without the passphrase to fail")
+	}
+
+	newKey, err := app.Rotate(RotateRequest{Passphrase: passphrase})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.rotation.wait()
+
+	app.Seal()
+	if _, err := app.unlock(passphraseRequest(passphrase)); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(app.keys.key()) != string(newKey) {
+		t.Error("expected passphrase to unlock the rotated key")
+	}
+}
+
+func TestValidatePassphrase(t *testing.T) {
+	if err := validatePassphrase("short"); err == nil {
+		t.Error("expected short passphrase to be rejected")
+	}
+
+	if err := (InitRequest{Shares: 3, Threshold: 2, Passphrase: "long enough"}).Validate(); err == nil {
+		t.Error("expected passphrase with shares to be rejected")
+	}
+}
+
+func TestKDFParamsBounds(t *testing.T) {
+	valid := newKDFParams()
+	tt := []struct {
+		name   string
+		modify func(*kdfParams)
+		err    bool
+	}{
+		{name: "default", modify: func(k *kdfParams) {}},
+		{name: "small", modify: func(k *kdfParams) { k.N, k.R, k.P = 1<<10, 1, 1 }},
+		{name: "unknown kdf", modify: func(k *kdfParams) { k.Name = "argon2" }, err: true},
+		{name: "huge n", modify: func(k *kdfParams) { k.N = 1 << 30 }, err: true},
+		{name: "n not a power of 2", modify: func(k *kdfParams) { k.N = 3000 }, err: true},
+		{name: "huge r", modify: func(k *kdfParams) { k.R = 1 << 10 }, err: true},
+		{name: "huge p", modify: func(k *kdfParams) { k.P = 64 }, err: true},
+		{name: "zero p", modify: func(k *kdfParams) { k.P = 0 }, err: true},
+	}
+
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			params := valid
+			v.modify(&params)
+
+			_, err := params.derive("correct horse battery staple")
+			if v.err && err == nil {
+				t.Error("expected error but got nil")
+			}
+
+			if !v.err && err != nil {
+				t.Errorf("expected parameters to be accepted but got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+const (
+	ProviderFile = "file"
+	ProviderAge  = "age"
+)
+
+// KeyProvider wraps the database key when the database is initialized and unwraps it when the service starts,
+// so the database can be unlocked without an operator supplying the key.
+type KeyProvider interface {
+	Name() string
+	Wrap(key []byte) ([]byte, error)
+	Unwrap(wrapped []byte) ([]byte, error)
+}
+
+// NewKeyProvider returns the key provider for the name using the key material at path. The age provider also
+// reads its recipients from recipientsPath. An empty name returns a nil provider which disables auto unlock.
+func NewKeyProvider(name, path, recipientsPath string) (KeyProvider, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case ProviderFile:
+		return NewFileKeyProvider(path)
+	case ProviderAge:
+		return NewAgeKeyProvider(path, recipientsPath)
+	}
+
+	return nil, fmt.Errorf("unknown key provider %s", name)
+}
+
+// GetKeyProviders returns the names of the supported key providers
+func GetKeyProviders() []string {
+	return []string{ProviderFile, ProviderAge}
+}
+
+// readKeyFile returns the first line of the file that is not empty or a comment
+func readKeyFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return line, nil
+	}
+
+	return "", fmt.Errorf("no key found in %s", path)
+}
+
+// FileKeyProvider wraps the database key with a 32 byte key read from a local file. The file
+// holds the key base64 encoded.
+type FileKeyProvider struct {
+	key []byte
+}
+
+// NewFileKeyProvider reads the wrapping key from the file at path
+func NewFileKeyProvider(path string) (*FileKeyProvider, error) {
+	line, err := readKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := fromBase64(strings.TrimRight(line, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key file: %v", err)
+	}
+
+	if len(key) != 32 {
+		return nil, fmt.Errorf("key file must hold a 32 byte key")
+	}
+
+	return &FileKeyProvider{key: key}, nil
+}
+
+func (f *FileKeyProvider) Name() string {
+	return ProviderFile
+}
+
+func (f *FileKeyProvider) Wrap(key []byte) ([]byte, error) {
+	return encrypt(key, f.key)
+}
+
+func (f *FileKeyProvider) Unwrap(wrapped []byte) ([]byte, error) {
+	return decrypt(wrapped, f.key)
+}
+
+// AgeKeyProvider encrypts the database key to age recipients and decrypts it with an age identity, so a wrapped key
+// can also be opened with `age -d`. Wrapping only needs the recipients. The identity file is only read to unwrap
+// the key on startup, and one of its identities must match a recipient so the service can open what it wraps.
+type AgeKeyProvider struct {
+	recipients []age.Recipient
+	identities []age.Identity
+}
+
+// NewAgeKeyProvider reads the age identities from the file at path and the recipients from the recipients file,
+// both in the format written by age-keygen
+func NewAgeKeyProvider(path, recipientsPath string) (*AgeKeyProvider, error) {
+	if recipientsPath == "" {
+		return nil, fmt.Errorf("the age provider requires a recipients file")
+	}
+
+	recipientsFile, err := os.Open(recipientsPath)
+	if err != nil {
+		return nil, err
+	}
+	defer recipientsFile.Close()
+
+	recipients, err := age.ParseRecipients(recipientsFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipients file: %v", err)
+	}
+
+	identityFile, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer identityFile.Close()
+
+	identities, err := age.ParseIdentities(identityFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid identity file: %v", err)
+	}
+
+	if !matchesRecipient(identities, recipients) {
+		return nil, fmt.Errorf("no identity in %s matches a recipient in %s", path, recipientsPath)
+	}
+
+	return &AgeKeyProvider{recipients: recipients, identities: identities}, nil
+}
+
+// matchesRecipient returns true if the recipient of any X25519 identity is one of the recipients
+func matchesRecipient(identities []age.Identity, recipients []age.Recipient) bool {
+	for _, i := range identities {
+		identity, ok := i.(*age.X25519Identity)
+		if !ok {
+			continue
+		}
+
+		for _, r := range recipients {
+			if recipient, ok := r.(*age.X25519Recipient); ok && recipient.String() == identity.Recipient().String() {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (a *AgeKeyProvider) Name() string {
+	return ProviderAge
+}
+
+func (a *AgeKeyProvider) Wrap(key []byte) ([]byte, error) {
+	var wrapped bytes.Buffer
+	w, err := age.Encrypt(&wrapped, a.recipients...)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Write(key); err != nil {
+		return nil, err
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return wrapped.Bytes(), nil
+}
+
+func (a *AgeKeyProvider) Unwrap(wrapped []byte) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(wrapped), a.identities...)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
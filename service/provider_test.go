@@ -0,0 +1,206 @@
+package service
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/CoverWhale/logr"
+)
+
+const (
+	testBase64Secret = "AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyA"
+)
+
+func writeKeyFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestKeyProviders(t *testing.T) {
+	tt := []struct {
+		name     string
+		provider string
+		contents string
+		err      bool
+	}{
+		{name: "key file", provider: ProviderFile, contents: toBase64(generateKey())},
+		{name: "padded key file", provider: ProviderFile, contents: testBase64Secret + "=\n"},
+		{name: "short key file", provider: ProviderFile, contents: "dGVzdA", err: true},
+		{name: "unknown provider", provider: "vault", contents: testBase64Secret, err: true},
+	}
+
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			provider, err := NewKeyProvider(v.provider, writeKeyFile(t, v.contents), "")
+			if err != nil && !v.err {
+				t.Fatal(err)
+			}
+
+			if v.err {
+				if err == nil {
+					t.Error("expected error but got nil")
+				}
+				return
+			}
+
+			key := generateKey()
+			wrapped, err := provider.Wrap(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			unwrapped, err := provider.Unwrap(wrapped)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(key, unwrapped) {
+				t.Error("unwrapped key does not match")
+			}
+		})
+	}
+}
+
+func TestAgeKeyProvider(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovery, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identityPath := writeKeyFile(t, "# service identity\n"+identity.String()+"\n")
+	recipientsPath := writeKeyFile(t, identity.Recipient().String()+"\n"+recovery.Recipient().String()+"\n")
+
+	provider, err := NewKeyProvider(ProviderAge, identityPath, recipientsPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key := generateKey()
+	wrapped, err := provider.Wrap(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unwrapped, err := provider.Unwrap(wrapped)
+	if err != nil || !bytes.Equal(key, unwrapped) {
+		t.Fatalf("expected the service identity to unwrap the key: %v", err)
+	}
+
+	// the wrapped key is a regular age file, so any recipient's identity opens it like age -d would
+	r, err := age.Decrypt(bytes.NewReader(wrapped), recovery)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decrypted, err := io.ReadAll(r); err != nil || !bytes.Equal(key, decrypted) {
+		t.Errorf("expected the recovery identity to decrypt the key: %v", err)
+	}
+
+	errs := []struct {
+		name       string
+		identity   string
+		recipients string
+	}{
+		{name: "no recipients", identity: identityPath},
+		{name: "identity not a recipient", identity: identityPath, recipients: writeKeyFile(t, recovery.Recipient().String())},
+		{name: "invalid identity", identity: writeKeyFile(t, testBase64Secret), recipients: recipientsPath},
+	}
+
+	for _, v := range errs {
+		t.Run(v.name, func(t *testing.T) {
+			if _, err := NewKeyProvider(ProviderAge, v.identity, v.recipients); err == nil {
+				t.Error("expected error but got nil")
+			}
+		})
+	}
+}
+
+func TestAutoUnlock(t *testing.T) {
+	app := newTestApp(t)
+
+	provider, err := NewFileKeyProvider(writeKeyFile(t, toBase64(generateKey())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Provider = provider
+
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.AutoUnlock(logr.NewLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(app.keys.key(), key) {
+		t.Fatal("expected database to be unlocked with the provider key")
+	}
+
+	newKey, err := app.Rotate(RotateRequest{CurrentKey: toBase64(key)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.rotation.wait()
+
+	app.Seal()
+	if err := app.AutoUnlock(logr.NewLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(app.keys.key(), newKey) {
+		t.Error("expected provider key to be updated after rotation")
+	}
+}
+
+func TestAutoUnlockExistingDatabase(t *testing.T) {
+	app := newTestApp(t)
+
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider, err := NewFileKeyProvider(writeKeyFile(t, toBase64(generateKey())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.Provider = provider
+
+	if err := app.AutoUnlock(logr.NewLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	if app.keys.unlocked() {
+		t.Fatal("expected database without a provider key to stay locked")
+	}
+
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	if mustInitRecord(t, app).ProviderKey == nil {
+		t.Fatal("expected manual unlock to wrap the key with the provider")
+	}
+
+	app.Seal()
+	if err := app.AutoUnlock(logr.NewLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(app.keys.key(), key) {
+		t.Error("expected database to be unlocked with the provider key")
+	}
+}
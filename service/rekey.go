@@ -0,0 +1,96 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// RekeyRequest replaces the material used to unlock the database. The caller proves they hold the current
+// unseal material with the key, its shares or the passphrase. New holds the unseal configuration to
+// issue, either a passphrase or a new key that is optionally split into shares.
+type RekeyRequest struct {
+	CurrentKey    string      `json:"current_key,omitempty"`
+	CurrentShares []string    `json:"current_shares,omitempty"`
+	Passphrase    string      `json:"passphrase,omitempty"`
+	New           InitRequest `json:"new"`
+}
+
+// Validate checks the new unseal configuration. The cipher is part of the data encryption and is changed with migrate.
+func (r RekeyRequest) Validate() error {
+	if r.New.Algorithm != "" {
+		return NewClientError(fmt.Errorf("the algorithm cannot be changed on rekey, use migrate"), 400)
+	}
+
+	return r.New.Validate()
+}
+
+// Rekey replaces the unseal material without changing the database key, so no secrets are rewrapped. The
+// database key is wrapped by a new unseal key or a key derived from the new passphrase, and the init record
+// is replaced only if it has not changed since it was read. The new unseal key is returned, it is nil when
+// the database is protected by a passphrase.
+func (a *AppContext) Rekey(req RekeyRequest) ([]byte, initRecord, error) {
+	if err := req.Validate(); err != nil {
+		return nil, initRecord{}, err
+	}
+
+	a.keys.change.Lock()
+	defer a.keys.change.Unlock()
+
+	record, revision, err := a.getInitRecordRevision()
+	if err != nil {
+		return nil, initRecord{}, err
+	}
+
+	currentKey, _, err := record.resolveKey(req.CurrentKey, req.CurrentShares, req.Passphrase)
+	if err != nil {
+		return nil, initRecord{}, err
+	}
+
+	if !bytes.Equal(currentKey, a.keys.key()) {
+		return nil, initRecord{}, NewClientError(fmt.Errorf("current unseal material does not match"), 401)
+	}
+
+	if err := record.open(currentKey); err != nil {
+		return nil, initRecord{}, err
+	}
+
+	var unsealKey []byte
+	record.Shares, record.Threshold = req.New.Shares, req.New.Threshold
+	record.KDF = nil
+	if req.New.Passphrase != "" {
+		kdf := newKDFParams()
+		kek, err := kdf.derive(req.New.Passphrase)
+		if err != nil {
+			return nil, initRecord{}, err
+		}
+		record.KDF = &kdf
+		record.kek = kek
+	} else {
+		unsealKey = generateKey()
+		record.kek = unsealKey
+	}
+
+	data, err := a.encodeInitRecord(record, a.keys.key())
+	if err != nil {
+		return nil, initRecord{}, err
+	}
+
+	_, err = a.KV.Update(initKey, data, revision)
+	if isRevisionConflict(err) {
+		return nil, initRecord{}, NewClientError(fmt.Errorf("init record changed during rekey, try again"), 409)
+	}
+
+	if err != nil {
+		return nil, initRecord{}, err
+	}
+
+	a.keys.dropShares()
+
+	event, err := json.Marshal(ResponseMessage{Details: "unseal material replaced"})
+	if err == nil {
+		a.publishEvent("rekey", event)
+	}
+
+	return unsealKey, record, nil
+}
@@ -0,0 +1,151 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestRekey(t *testing.T) {
+	app, nc := newTestService(t)
+	client := Client{Conn: nc}
+
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := &JetStreamRecord{
+		bucket: piggyBucket,
+		key:    "app.password",
+		value:  []byte("hunter2"),
+		keys:   app.keys,
+	}
+	if err := app.addRecord(secret); err != nil {
+		t.Fatal(err)
+	}
+
+	relock := func() {
+		app.Seal()
+	}
+
+	expectCode := func(err error, code int) {
+		t.Helper()
+		var clientErr ClientError
+		if !errors.As(err, &clientErr) || clientErr.Code != code {
+			t.Fatalf("expected %d but got %v", code, err)
+		}
+	}
+
+	// rekey sends the request to the endpoint and returns its response, which holds the new unseal material
+	rekey := func(req RekeyRequest) ResponseMessage {
+		t.Helper()
+		request, err := NewRekeyRequest(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := client.DoResponse(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return resp
+	}
+
+	_, _, err = app.Rekey(RekeyRequest{CurrentKey: toBase64(generateKey()), New: InitRequest{Shares: 3, Threshold: 2}})
+	expectCode(err, 401)
+
+	shares := rekey(RekeyRequest{CurrentKey: toBase64(key), New: InitRequest{Shares: 3, Threshold: 2}}).Shares
+	if len(shares) != 3 || !mustInitRecord(t, app).wrapped() {
+		t.Fatalf("expected 3 shares of a new unseal key wrapping the database key but got %d", len(shares))
+	}
+
+	relock()
+	if _, err := app.unlock(unlockRequest(t, shares[0])); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, shares[2])); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(app.keys.key()) != string(key) {
+		t.Fatal("expected rekey to keep the database key")
+	}
+
+	value, err := app.getRecord(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "hunter2" {
+		t.Errorf("expected hunter2 but got %s", value)
+	}
+
+	passphrase := "correct horse battery staple"
+	if resp := rekey(RekeyRequest{CurrentShares: shares[1:], New: InitRequest{Passphrase: passphrase}}); len(resp.Shares) != 0 {
+		t.Fatal("expected no unseal material in the response for a passphrase")
+	}
+
+	relock()
+	_, err = app.unlock(unlockRequest(t, shares[0]))
+	expectCode(err, 400)
+
+	data, err := json.Marshal(DatabaseKey{Passphrase: passphrase})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(data); err != nil {
+		t.Fatal(err)
+	}
+
+	unsealKey := rekey(RekeyRequest{Passphrase: passphrase, New: InitRequest{}}).Details
+
+	relock()
+	_, err = app.unlock(data)
+	expectCode(err, 400)
+
+	_, err = app.unlock(unlockRequest(t, toBase64(key)))
+	expectCode(err, 401)
+
+	if _, err := app.unlock(unlockRequest(t, unsealKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	newKey, err := app.Rotate(RotateRequest{CurrentKey: unsealKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.rotation.wait()
+
+	relock()
+	if _, err := app.unlock(unlockRequest(t, unsealKey)); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(app.keys.key()) != string(newKey) {
+		t.Error("expected the unseal key to unlock the rotated database key")
+	}
+}
+
+func TestRekeyValidate(t *testing.T) {
+	tt := []struct {
+		name string
+		req  RekeyRequest
+	}{
+		{name: "algorithm", req: RekeyRequest{New: InitRequest{Algorithm: algXChaCha20Poly1305}}},
+		{name: "threshold", req: RekeyRequest{New: InitRequest{Shares: 3, Threshold: 4}}},
+		{name: "short passphrase", req: RekeyRequest{New: InitRequest{Passphrase: "short"}}},
+	}
+
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			if err := v.req.Validate(); err == nil {
+				t.Error("expected error")
+			}
+		})
+	}
+}
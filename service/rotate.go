@@ -2,128 +2,465 @@ package service
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/nats-io/nats.go"
 )
 
-type rotatedKV struct {
-	subject string
-	value   []byte
-	rotated bool
-	oldKey  []byte
-	newKey  []byte
+const (
+	rotationKey                = systemPrefix + "rotation"
+	rotationCheckpointInterval = 100
+	rotationRetries            = 3
+	RotationRunning            = "running"
+	RotationComplete           = "complete"
+	RotationFailed             = "failed"
+	RotationKindRotate         = "rotation"
+	RotationKindMigrate        = "migration"
+)
+
+// RotationStatus is the checkpoint for a key rotation. It is stored in the KV bucket so a rotation
+// can be resumed after a restart. Secrets are rewrapped in sorted order and LastKey holds the last
+// secret that was processed. Migrations use the same job to upgrade secrets to the latest format
+// without changing the key.
+type RotationStatus struct {
+	Details   string    `json:"details,omitempty"`
+	Kind      string    `json:"kind,omitempty"`
+	State     string    `json:"state"`
+	KeyID     string    `json:"key_id"`
+	LastKey   string    `json:"last_key,omitempty"`
+	Processed int       `json:"processed"`
+	Failed    []string  `json:"failed,omitempty"`
+	Started   time.Time `json:"started"`
+	Updated   time.Time `json:"updated"`
 }
 
-func buildKeys(newKey []byte, w nats.KeyWatcher) []rotatedKV {
-	kvs := []rotatedKV{}
-	for v := range w.Updates() {
-		if v == nil {
-			break
-		}
+// rotationJob guards against more than one rotation job running at a time for a bank
+type rotationJob struct {
+	mu      sync.Mutex
+	running bool
+	wg      sync.WaitGroup
+}
+
+// start marks a rotation job as running. It returns false if a job is already running.
+func (r *rotationJob) start() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.running {
+		return false
+	}
+
+	r.running = true
+	r.wg.Add(1)
+
+	return true
+}
+
+func (r *rotationJob) finish() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
 
-		kvs = append(kvs, rotatedKV{
-			subject: v.Key(),
-			value:   v.Value(),
-			oldKey:  databaseKey,
-			newKey:  newKey,
-		})
+	r.running = false
+	r.wg.Done()
+}
+
+// wait blocks until the running rotation job returns
+func (r *rotationJob) wait() {
+	r.wg.Wait()
+}
+
+func (r RotationStatus) summary() string {
+	kind := r.Kind
+	if kind == "" {
+		kind = RotationKindRotate
 	}
 
-	return kvs
+	return fmt.Sprintf("key %s %s, %d secrets processed, %d failed", kind, r.State, r.Processed, len(r.Failed))
 }
 
-func (a *AppContext) Rotate(currentKey string) ([]byte, error) {
-	currentKeyBytes, err := fromBase64(currentKey)
+// Rotate replaces the database key with a new key. The new key is stored first, keeping the old key in the
+// keyring, so secrets can still be read while they are rewrapped. Secrets are rewrapped by a background job
+// which removes the old key from the keyring once every secret is wrapped by the new key. The caller proves
+// they hold the current key with the key itself, its shares or the passphrase protecting it.
+func (a *AppContext) Rotate(req RotateRequest) ([]byte, error) {
+	a.keys.change.Lock()
+	defer a.keys.change.Unlock()
+
+	record, err := a.getInitRecord()
+	if err != nil {
+		return nil, err
+	}
+
+	currentKey, kek, err := record.resolveKey(req.CurrentKey, req.CurrentShares, req.Passphrase)
 	if err != nil {
-		return nil, NewClientError(fmt.Errorf("%v", err), 400)
+		return nil, err
 	}
 
-	if !bytes.Equal(currentKeyBytes, databaseKey) {
+	if !bytes.Equal(currentKey, a.keys.key()) {
 		return nil, NewClientError(fmt.Errorf("current database key does not match"), 401)
 	}
 
+	if err := record.open(currentKey); err != nil {
+		return nil, err
+	}
+
+	record.kek = kek
+
+	if !a.rotation.start() {
+		return nil, NewClientError(fmt.Errorf("key rotation already in progress"), 409)
+	}
+
 	a.logger.Info("generating new key")
 	newKey := generateKey()
+	oldID := a.keys.currentID()
 
-	w, err := a.KV.WatchAll(nats.IgnoreDeletes())
-	if err != nil {
+	a.keys.rotate(newKey)
+	if err := a.putInitRecord(record, newKey); err != nil {
+		a.keys.restore(oldID)
+		a.rotation.finish()
 		return nil, err
 	}
 
-	kvs := buildKeys(newKey, w)
+	status := RotationStatus{
+		Kind:    RotationKindRotate,
+		State:   RotationRunning,
+		KeyID:   keyID(newKey),
+		Started: time.Now(),
+	}
 
-	updated, err := a.rotateKey(kvs)
-	if err != nil {
-		return nil, a.rollbackKey(updated)
+	go a.runRotation(status)
+
+	return newKey, nil
+}
+
+// Migrate upgrades every secret to the latest envelope format in the background without changing the key.
+// If an algorithm is passed the database cipher is changed and every secret is sealed again with it.
+// Progress is reported the same way as a key rotation.
+func (a *AppContext) Migrate(algorithm string) error {
+	a.keys.change.Lock()
+	defer a.keys.change.Unlock()
+
+	c := a.keys.sealCipher()
+	if algorithm != "" {
+		var err error
+		c, err = getCipher(algorithm)
+		if err != nil {
+			return NewClientError(err, 400)
+		}
 	}
 
-	databaseKey = newKey
+	if !a.rotation.start() {
+		return NewClientError(fmt.Errorf("key rotation already in progress"), 409)
+	}
+
+	if c.ID() != a.keys.sealCipher().ID() {
+		record, err := a.getInitRecord()
+		if err == nil {
+			err = record.open(a.keys.key())
+		}
+		if err != nil {
+			a.rotation.finish()
+			return err
+		}
+
+		a.logger.Infof("changing database cipher to %s", c.ID())
+		record.Algorithm = c.ID()
+		if err := a.putInitRecord(record, a.keys.key()); err != nil {
+			a.rotation.finish()
+			return err
+		}
+		a.keys.setCipher(c)
+	}
+
+	status := RotationStatus{
+		Kind:    RotationKindMigrate,
+		State:   RotationRunning,
+		KeyID:   a.keys.currentID(),
+		Started: time.Now(),
+	}
+
+	go a.runRotation(status)
 
-	return []byte(newKey), nil
+	return nil
 }
 
-func (a *AppContext) rollbackKey(kvs []rotatedKV) error {
-	var failedKeys []string
-	logger := a.logger.WithContext(map[string]string{"rotation_step": "rollback"})
-	for _, v := range kvs {
-		if v.rotated == true {
-			logger.Infof("rolling back secret: %s", v.subject)
+// resumeRotation starts the rotation job again if it was interrupted by a restart or the database being locked.
+// If previous keys are in the keyring without a matching checkpoint, a new job is started to rewrap them.
+func (a *AppContext) resumeRotation() {
+	status, err := a.getRotationStatus()
+	if err != nil && err != nats.ErrKeyNotFound {
+		a.logger.Errorf("error getting rotation status: %v", err)
+		return
+	}
 
-			decrypted, err := decrypt(v.value, v.oldKey)
-			if err != nil {
-				logger.Errorf("error in getting secret %s: %v", v.subject, err)
-				failedKeys = append(failedKeys, v.subject)
-				continue
-			}
+	currentID := a.keys.currentID()
+	if status.State != RotationRunning || status.KeyID != currentID {
+		if len(a.keys.previousKeys()) == 0 || status.KeyID == currentID {
+			return
+		}
+
+		status = RotationStatus{
+			Kind:    RotationKindRotate,
+			State:   RotationRunning,
+			KeyID:   currentID,
+			Started: time.Now(),
+		}
+	}
 
-			record := JetStreamRecord{
-				encryptionKey: v.oldKey,
-				bucket:        piggyBucket,
-				key:           v.subject,
-				value:         decrypted,
+	if !a.rotation.start() {
+		return
+	}
+
+	a.logger.Infof("resuming key rotation after %s", status.LastKey)
+	go a.runRotation(status)
+}
+
+// runRotation rewraps every secret with the database key in the status starting after the last checkpoint.
+// If the database is locked or the key changes the job stops and is resumed on the next unlock.
+func (a *AppContext) runRotation(status RotationStatus) {
+	defer a.rotation.finish()
+	logger := a.logger.WithContext(map[string]string{"rotation_step": "rewrap"})
+
+	if err := a.checkpointRotation(&status); err != nil {
+		logger.Errorf("error storing rotation checkpoint: %v", err)
+	}
+
+	names, err := a.KV.Keys()
+	if err != nil && err != nats.ErrNoKeysFound {
+		logger.Errorf("error listing secrets for rotation: %v", err)
+		return
+	}
+	sort.Strings(names)
+
+	for _, k := range names {
+		if k <= status.LastKey || internalKey(k) {
+			continue
+		}
+
+		err := a.rewrapSecret(k, status.KeyID)
+		if errors.Is(err, errKeyChanged) {
+			logger.Info("database key changed, pausing rotation")
+			if err := a.checkpointRotation(&status); err != nil {
+				logger.Errorf("error storing rotation checkpoint: %v", err)
 			}
+			return
+		}
 
-			if err := a.addRecord(&record); err != nil {
-				failedKeys = append(failedKeys, v.subject)
-				logger.Errorf("error rolling back encryption key on secret %s: %v", v.subject, err)
-				continue
+		if err != nil {
+			logger.Errorf("key rotation error in rewrapping secret %s: %v", k, err)
+			status.Failed = append(status.Failed, k)
+		}
+
+		status.Processed++
+		status.LastKey = k
+
+		if status.Processed%rotationCheckpointInterval == 0 {
+			if err := a.checkpointRotation(&status); err != nil {
+				logger.Errorf("error storing rotation checkpoint: %v", err)
 			}
 		}
 	}
 
-	if len(failedKeys) > 0 {
-		return fmt.Errorf("error rolling back keys: %v", failedKeys)
+	status.State = RotationComplete
+	if len(status.Failed) > 0 {
+		status.State = RotationFailed
 	}
 
-	return nil
+	if err := a.retireKeys(status.KeyID, status.Failed); err != nil {
+		logger.Errorf("error removing retired keys from keyring: %v", err)
+	} else {
+		a.syncKey()
+	}
+
+	if err := a.checkpointRotation(&status); err != nil {
+		logger.Errorf("error storing rotation checkpoint: %v", err)
+	}
+
+	logger.Info(status.summary())
 }
 
-func (a *AppContext) rotateKey(kvs []rotatedKV) ([]rotatedKV, error) {
-	logger := a.logger.WithContext(map[string]string{"rotation_step": "rotate"})
-	for k, v := range kvs {
-		logger.Infof("re-encrypting secret %s", v.subject)
+// internalKey returns true for the keys the service stores in the bucket for itself that are not sealed by
+// the database key. Transit keys are sealed, so they are rewrapped like secrets.
+func internalKey(k string) bool {
+	return systemKey(k) && !strings.HasPrefix(k, transitKeyPrefix)
+}
+
+// rewrapSecret wraps a single secret with the current key if it is not already wrapped by it. If the current key
+// no longer has the new key ID errKeyChanged is returned. The write is checked against the revision that was read
+// so a secret written during the rotation is never overwritten with a stale value. On a conflict the secret is
+// read again and retried.
+func (a *AppContext) rewrapSecret(k string, newKeyID string) error {
+	for i := 0; i < rotationRetries; i++ {
+		entry, err := a.KV.Get(k)
+		if err == nats.ErrKeyNotFound {
+			return nil
+		}
 
-		decrypted, err := decrypt(v.value, v.oldKey)
 		if err != nil {
-			logger.Errorf("key rotation error in getting secret %s: %v", v.subject, err)
-			return kvs, err
+			return err
+		}
+
+		rewrapped, err := a.keys.rewrap(k, entry.Revision(), entry.Value(), newKeyID)
+		if err != nil || rewrapped == nil {
+			return err
+		}
+
+		revision, err := a.KV.Update(k, rewrapped, entry.Revision())
+		if err == nil {
+			return a.followRewrap(k, entry.Revision(), revision)
 		}
 
-		record := JetStreamRecord{
-			encryptionKey: v.newKey,
-			bucket:        piggyBucket,
-			key:           v.subject,
-			value:         decrypted,
+		if !isRevisionConflict(err) {
+			return err
 		}
 
-		if err := a.addRecord(&record); err != nil {
-			logger.Errorf("key rotation error updating secret %s: %v", v.subject, err)
-			return kvs, err
+		a.logger.Debugf("secret %s changed during rotation, retrying", k)
+	}
+
+	return fmt.Errorf("secret %s kept changing during rotation", k)
+}
+
+// retireKeys removes previous keys from the keyring that no longer wrap any secrets. Every secret is checked
+// again while holding the change lock, since another instance still on an older key may have written one after
+// it was rewrapped. Those are rewrapped once more, and keys still wrapping a secret are kept so the rotation can
+// be run again. Nothing is retired if the current key no longer has the new key ID. If every secret was
+// rewrapped they are all in the current envelope format, so the database is marked migrated and older formats
+// are refused from then on.
+func (a *AppContext) retireKeys(newKeyID string, failed []string) error {
+	a.keys.change.Lock()
+	defer a.keys.change.Unlock()
+
+	if a.keys.currentID() != newKeyID {
+		return errKeyChanged
+	}
+
+	retain, err := a.wrappingKeys(newKeyID)
+	if err != nil {
+		return err
+	}
+
+	for id := range a.keys.previousKeys() {
+		// secrets without a key ID could have been wrapped by any previous key
+		if retain[id] || retain[""] {
+			continue
 		}
-		kvs[k].rotated = true
+		a.logger.Infof("retiring key %s", id)
+		a.keys.retire(id)
+	}
+
+	record, err := a.getInitRecord()
+	if err != nil {
+		return err
+	}
+
+	if err := record.open(a.keys.key()); err != nil {
+		return err
+	}
+
+	if len(failed) == 0 && !record.Migrated {
+		a.logger.Info("every secret is in the current format, refusing older formats")
+		record.Migrated = true
 	}
 
-	return kvs, nil
+	if err := a.putInitRecord(record, a.keys.key()); err != nil {
+		return err
+	}
+
+	return a.loadLegacyRevision(record)
+}
+
+// wrappingKeys returns the IDs of the keys other than the new key that still wrap a secret. Secrets wrapped by
+// another key are rewrapped first, and an error reading any secret is returned so no key is retired while it
+// may still be in use. The caller must hold the change lock.
+func (a *AppContext) wrappingKeys(newKeyID string) (map[string]bool, error) {
+	names, err := a.KV.Keys()
+	if err != nil && err != nats.ErrNoKeysFound {
+		return nil, err
+	}
+
+	retain := map[string]bool{}
+	for _, k := range names {
+		if internalKey(k) {
+			continue
+		}
+
+		id, err := a.wrappingKey(k)
+		if err != nil {
+			return nil, err
+		}
+
+		if id == newKeyID {
+			continue
+		}
+
+		a.logger.Infof("secret %s is not wrapped by the new key, rewrapping", k)
+		if err := a.rewrapSecret(k, newKeyID); err != nil {
+			a.logger.Errorf("key rotation error in rewrapping secret %s: %v", k, err)
+		}
+
+		id, err = a.wrappingKey(k)
+		if err != nil {
+			return nil, err
+		}
+
+		if id != newKeyID {
+			retain[id] = true
+		}
+	}
+
+	return retain, nil
+}
+
+// wrappingKey returns the ID of the key wrapping the secret. Values without a key ID could have been wrapped
+// by any key and return an empty ID.
+func (a *AppContext) wrappingKey(k string) (string, error) {
+	entry, err := a.KV.Get(k)
+	if err == nats.ErrKeyNotFound {
+		return a.keys.currentID(), nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	env, _ := parseEnvelope(entry.Value())
+
+	return env.KeyID, nil
+}
+
+// checkpointRotation stores the rotation status in the KV bucket and publishes it as an event
+func (a *AppContext) checkpointRotation(status *RotationStatus) error {
+	status.Updated = time.Now()
+	status.Details = status.summary()
+
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	a.publishEvent("rotate", data)
+
+	_, err = a.KV.Put(rotationKey, data)
+
+	return err
+}
+
+func (a *AppContext) getRotationStatus() (RotationStatus, error) {
+	entry, err := a.KV.Get(rotationKey)
+	if err != nil {
+		return RotationStatus{}, err
+	}
+
+	var status RotationStatus
+	if err := json.Unmarshal(entry.Value(), &status); err != nil {
+		return RotationStatus{}, err
+	}
 
+	return status, nil
 }
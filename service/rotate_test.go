@@ -2,7 +2,9 @@ package service
 
 import (
 	"encoding/json"
+	"fmt"
 	"os"
+	"sync"
 	"testing"
 
 	"github.com/CoverWhale/logr"
@@ -61,12 +63,10 @@ func setupEncryptedVals(t *testing.T, server *server.Server, vals map[string]str
 		t.Fatal(err)
 	}
 
-	app := AppContext{
-		KV:     kv,
-		logger: logr.NewLogger(),
-	}
+	app := NewAppContext(kv)
+	app.logger = logr.NewLogger()
 
-	key, err := app.initialize()
+	key, err := app.initialize(InitRequest{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -77,16 +77,16 @@ func setupEncryptedVals(t *testing.T, server *server.Server, vals map[string]str
 		t.Fatal(err)
 	}
 
-	if err := app.unlock(data); err != nil {
+	if _, err := app.unlock(data); err != nil {
 		t.Fatal(err)
 	}
 
 	for k, v := range vals {
 		record := JetStreamRecord{
-			encryptionKey: key,
-			bucket:        piggyBucket,
-			key:           k,
-			value:         []byte(v),
+			keys:   app.keys,
+			bucket: piggyBucket,
+			key:    k,
+			value:  []byte(v),
 		}
 		if err := app.addRecord(&record); err != nil {
 			t.Error(err)
@@ -102,20 +102,20 @@ func TestRotation(t *testing.T) {
 		name     string
 		vals     map[string]string
 		expected map[string]string
-		rollback bool
+		corrupt  bool
 		err      bool
 	}{
 		{
 			name:     "normal rotation",
-			rollback: false,
+			corrupt:  false,
 			vals:     testVals,
 			expected: testVals,
 			err:      false,
 		},
 		{
-			name:     "rollback with error",
-			rollback: true,
-			vals:     testVals,
+			name:    "rotation skips unreadable secret",
+			corrupt: true,
+			vals:    testVals,
 			expected: map[string]string{
 				"piggybank.secrets.secret1": "thesecret",
 				"piggybank.secrets.secret2": "other secret",
@@ -128,36 +128,51 @@ func TestRotation(t *testing.T) {
 
 	for _, v := range tt {
 		t.Run(v.name, func(t *testing.T) {
-			databaseKey = nil
 			server := NewServer(t)
 			defer shutdownJSServerAndRemoveStorage(t, server)
 
 			key, app := setupEncryptedVals(t, server, v.vals)
 
-			// Change one key with bad data to cause rollback
-			if v.rollback {
-				record := JetStreamRecord{
-					encryptionKey: generateKey(),
-					bucket:        piggyBucket,
-					key:           "piggybank.secrets.secret3",
-					value:         []byte("other secret"),
+			// Change one key with bad data so it cannot be rewrapped
+			if v.corrupt {
+				corrupt, err := sealEnvelope(aesGCM{}, "piggybank.secrets.secret3", []byte("other secret"), generateKey())
+				if err != nil {
+					t.Fatal(err)
 				}
-				if err := app.addRecord(&record); err != nil {
+				if _, err := app.KV.Put("piggybank.secrets.secret3", corrupt); err != nil {
 					t.Error(err)
 				}
 			}
 
-			_, err := app.Rotate(toBase64(key))
-			if err != nil && !v.err {
+			newKey, err := app.Rotate(RotateRequest{CurrentKey: toBase64(key)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			app.rotation.wait()
+
+			status, err := app.getRotationStatus()
+			if err != nil {
 				t.Fatal(err)
 			}
 
+			if status.Processed != len(v.vals) {
+				t.Errorf("expected %d secrets processed but got %d", len(v.vals), status.Processed)
+			}
+
+			if len(app.keys.previousKeys()) != 0 {
+				t.Errorf("expected old key to be retired but keyring has %d keys", len(app.keys.previousKeys()))
+			}
+
+			if _, err := decrypt(mustInitRecord(t, app).Check, newKey); err != nil {
+				t.Errorf("expected init record to be updated with new key: %v", err)
+			}
+
 			for sub := range v.vals {
 				record := JetStreamRecord{
 					bucket: piggyBucket,
 					key:    sub,
 				}
-				decrypted, err := app.getRecord(&record, databaseKey)
+				decrypted, err := app.getRecord(&record)
 				if err != nil && !v.err {
 					t.Error(err)
 				}
@@ -171,3 +186,336 @@ func TestRotation(t *testing.T) {
 	}
 
 }
+
+func mustInitRecord(t *testing.T, app AppContext) initRecord {
+	t.Helper()
+	record, err := app.getInitRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return record
+}
+
+func TestReadDuringRotation(t *testing.T) {
+	server := NewServer(t)
+	defer shutdownJSServerAndRemoveStorage(t, server)
+
+	_, app := setupEncryptedVals(t, server, testVals)
+	record := mustInitRecord(t, app)
+
+	// simulate an interrupted rotation where the new key is stored but no secrets are rewrapped
+	newKey := generateKey()
+	app.keys.rotate(newKey)
+	if err := app.putInitRecord(record, newKey); err != nil {
+		t.Fatal(err)
+	}
+	app.Seal()
+
+	kv := JetStreamRecord{
+		bucket: piggyBucket,
+		key:    initKey,
+		value:  []byte(toBase64(newKey)),
+	}
+	if err := app.Unlock(&kv); err != nil {
+		t.Fatal(err)
+	}
+
+	// unlocking resumes the rewrap in the background, reads work with either key while it runs
+	for sub, expected := range testVals {
+		decrypted, err := app.getRecord(&JetStreamRecord{bucket: piggyBucket, key: sub})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(decrypted) != expected {
+			t.Errorf("expected %s but got %s", expected, string(decrypted))
+		}
+	}
+
+	app.rotation.wait()
+
+	if len(app.keys.previousKeys()) != 0 {
+		t.Errorf("expected keyring to be empty after resumed rotation but has %d keys", len(app.keys.previousKeys()))
+	}
+
+	status, err := app.getRotationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.State != RotationComplete {
+		t.Errorf("expected rotation to be %s but got %s", RotationComplete, status.State)
+	}
+}
+
+func TestResumeRotationCheckpoint(t *testing.T) {
+	server := NewServer(t)
+	defer shutdownJSServerAndRemoveStorage(t, server)
+
+	_, app := setupEncryptedVals(t, server, testVals)
+	record := mustInitRecord(t, app)
+
+	// simulate a crash after secret1 and secret2 were rewrapped
+	newKey := generateKey()
+	app.keys.rotate(newKey)
+	if err := app.putInitRecord(record, newKey); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"piggybank.secrets.secret1", "piggybank.secrets.secret2"} {
+		if err := app.rewrapSecret(k, keyID(newKey)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	status := RotationStatus{
+		State:     RotationRunning,
+		KeyID:     keyID(newKey),
+		LastKey:   "piggybank.secrets.secret2",
+		Processed: 2,
+	}
+	if err := app.checkpointRotation(&status); err != nil {
+		t.Fatal(err)
+	}
+
+	app.Seal()
+	kv := JetStreamRecord{
+		bucket: piggyBucket,
+		key:    initKey,
+		value:  []byte(toBase64(newKey)),
+	}
+	if err := app.Unlock(&kv); err != nil {
+		t.Fatal(err)
+	}
+	app.rotation.wait()
+
+	status, err := app.getRotationStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status.Processed != len(testVals) {
+		t.Errorf("expected %d secrets processed but got %d", len(testVals), status.Processed)
+	}
+
+	for sub, expected := range testVals {
+		decrypted, err := app.getRecord(&JetStreamRecord{bucket: piggyBucket, key: sub})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(decrypted) != expected {
+			t.Errorf("expected %s but got %s", expected, string(decrypted))
+		}
+	}
+}
+
+func TestRotationWithConcurrentWrites(t *testing.T) {
+	server := NewServer(t)
+	defer shutdownJSServerAndRemoveStorage(t, server)
+
+	key, app := setupEncryptedVals(t, server, testVals)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				record := JetStreamRecord{
+					keys:   app.keys,
+					bucket: piggyBucket,
+					key:    fmt.Sprintf("piggybank.secrets.writer%d", i),
+					value:  []byte(fmt.Sprintf("value %d", j)),
+				}
+				if _, err := app.putRecord(&record); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(i)
+	}
+
+	if _, err := app.Rotate(RotateRequest{CurrentKey: toBase64(key)}); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+	app.rotation.wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if len(app.keys.previousKeys()) != 0 {
+		t.Errorf("expected keyring to be empty after rotation but has %d keys", len(app.keys.previousKeys()))
+	}
+
+	for i := 0; i < 4; i++ {
+		secret := &JetStreamRecord{bucket: piggyBucket, key: fmt.Sprintf("piggybank.secrets.writer%d", i)}
+		if value, err := app.getRecord(secret); err != nil || string(value) != "value 24" {
+			t.Errorf("expected the last write to writer%d to be readable but got %s: %v", i, value, err)
+		}
+	}
+}
+
+func TestRetireKeysAfterStaleWrite(t *testing.T) {
+	server := NewServer(t)
+	defer shutdownJSServerAndRemoveStorage(t, server)
+
+	key, app := setupEncryptedVals(t, server, testVals)
+	record := mustInitRecord(t, app)
+
+	newKey := generateKey()
+	newID := keyID(newKey)
+	app.keys.rotate(newKey)
+	if err := app.putInitRecord(record, newKey); err != nil {
+		t.Fatal(err)
+	}
+	for k := range testVals {
+		if err := app.rewrapSecret(k, newID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// another instance still on the old key writes a secret after it was rewrapped
+	stale, err := sealEnvelope(aesGCM{}, "piggybank.secrets.secret1", []byte("stale write"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.KV.Put("piggybank.secrets.secret1", stale); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := app.retireKeys(newID, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	secret := &JetStreamRecord{bucket: piggyBucket, key: "piggybank.secrets.secret1"}
+	if value, err := app.getRecord(secret); err != nil || string(value) != "stale write" {
+		t.Errorf("expected the stale write to be readable after the old key was retired but got %s: %v", value, err)
+	}
+
+	entry, err := app.KV.Get("piggybank.secrets.secret1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if env, ok := parseEnvelope(entry.Value()); !ok || env.KeyID != newID {
+		t.Error("expected the stale write to be rewrapped with the new key")
+	}
+
+	if len(app.keys.previousKeys()) != 0 {
+		t.Errorf("expected keyring to be empty but has %d keys", len(app.keys.previousKeys()))
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	server := NewServer(t)
+	defer shutdownJSServerAndRemoveStorage(t, server)
+
+	key, app := setupEncryptedVals(t, server, testVals)
+
+	for sub, val := range testVals {
+		if _, err := app.KV.Put(sub, sealV1Envelope(t, []byte(val), key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reloadLegacy(t, app, key)
+
+	if err := app.Migrate(""); err != nil {
+		t.Fatal(err)
+	}
+	app.rotation.wait()
+
+	for sub, expected := range testVals {
+		entry, err := app.KV.Get(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env, ok := parseEnvelope(entry.Value())
+		if !ok || !env.current(aesGCM{}, key) {
+			t.Errorf("expected %s to be migrated to version %d", sub, envelopeVersion)
+		}
+
+		decrypted, err := app.getRecord(&JetStreamRecord{bucket: piggyBucket, key: sub})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(decrypted) != expected {
+			t.Errorf("expected %s but got %s", expected, string(decrypted))
+		}
+	}
+}
+
+func TestMigrateCipher(t *testing.T) {
+	server := NewServer(t)
+	defer shutdownJSServerAndRemoveStorage(t, server)
+
+	key, app := setupEncryptedVals(t, server, testVals)
+
+	if err := app.Migrate(algXChaCha20Poly1305); err != nil {
+		t.Fatal(err)
+	}
+	app.rotation.wait()
+
+	if mustInitRecord(t, app).Algorithm != algXChaCha20Poly1305 {
+		t.Errorf("expected init record algorithm to be %s", algXChaCha20Poly1305)
+	}
+
+	for sub, expected := range testVals {
+		entry, err := app.KV.Get(sub)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env, ok := parseEnvelope(entry.Value())
+		if !ok || !env.current(xChaCha20Poly1305{}, key) {
+			t.Errorf("expected %s to be sealed with %s", sub, algXChaCha20Poly1305)
+		}
+
+		decrypted, err := app.getRecord(&JetStreamRecord{bucket: piggyBucket, key: sub})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(decrypted) != expected {
+			t.Errorf("expected %s but got %s", expected, string(decrypted))
+		}
+	}
+}
+
+func TestRotateKeyResponse(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := NewDBRequest(DBRotate, toBase64(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{Conn: nc}
+	newKey, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.rotation.wait()
+
+	// a restarted service only has the init record, so the key in the response must unlock it
+	app.Seal()
+	if _, err := app.unlock(unlockRequest(t, newKey)); err != nil {
+		t.Fatalf("expected the rotated key returned by the endpoint to unlock the database: %v", err)
+	}
+
+	app.Seal()
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err == nil {
+		t.Error("expected the replaced key to no longer unlock the database")
+	}
+}
@@ -0,0 +1,78 @@
+package service
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	RecipientKeyHeader = "Piggybank-Recipient-Key"
+	SealedByHeader     = "Piggybank-Sealed-By"
+)
+
+// sealedSubject returns true for requests whose responses carry secrets
+func sealedSubject(subject string) bool {
+	return strings.HasPrefix(subject, fmt.Sprintf("%s.%s.", secretSubject, GET)) ||
+		strings.HasPrefix(subject, fmt.Sprintf("%s.%s.", transitSubject, TransitDecrypt))
+}
+
+// respondSealed responds with the JSON encoded value. If the request carries a recipient key the response is
+// sealed to it with a new curve key used only for this response, so only the holder of the recipient's private
+// key can read it. The public half of the sending key is returned in the sealed by header.
+func respondSealed(r micro.Request, v any) error {
+	recipient := r.Headers().Get(RecipientKeyHeader)
+	if recipient == "" {
+		return r.RespondJSON(v)
+	}
+
+	if !nkeys.IsValidPublicCurveKey(recipient) {
+		return NewClientError(fmt.Errorf("invalid recipient key"), 400)
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	defer zero(data)
+
+	sender, err := nkeys.CreateCurveKeys()
+	if err != nil {
+		return err
+	}
+	defer sender.Wipe()
+
+	public, err := sender.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	sealed, err := sender.Seal(data, recipient)
+	if err != nil {
+		return err
+	}
+
+	header := micro.Headers{}
+	nats.Header(header).Set(SealedByHeader, public)
+
+	return r.Respond(sealed, micro.WithHeaders(header))
+}
+
+// openResponse opens a response sealed to the recipient key
+func openResponse(recipient nkeys.KeyPair, msg *nats.Msg) ([]byte, error) {
+	sender := msg.Header.Get(SealedByHeader)
+	if sender == "" {
+		return nil, fmt.Errorf("response is not sealed")
+	}
+
+	opened, err := recipient.Open(msg.Data, sender)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open sealed response: %w", err)
+	}
+
+	return opened, nil
+}
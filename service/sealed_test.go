@@ -0,0 +1,96 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nkeys"
+)
+
+func TestSealedGet(t *testing.T) {
+	signer, err := nkeys.CreateServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := signer.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app, nc := newTestService(t, func(a *AppContext) { a.Signer = signer })
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{Conn: nc, ServiceKey: public}
+	if _, err := client.Post("app.secret", []byte("thesecret")); err != nil {
+		t.Fatal(err)
+	}
+
+	secret, err := client.Get("app.secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "thesecret" {
+		t.Errorf("expected thesecret but got %s", secret)
+	}
+
+	subject := "piggybank.secrets.GET.app.secret"
+	recipient, err := nkeys.CreateCurveKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	recipientPublic, err := recipient.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a subscriber on the reply inbox only sees the sealed secret
+	msg := nats.NewMsg(subject)
+	msg.Header.Set(RecipientKeyHeader, recipientPublic)
+	sealed, err := nc.RequestMsg(msg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed.Data, []byte("thesecret")) || sealed.Header.Get(SealedByHeader) == "" {
+		t.Error("expected response to be sealed to the recipient key")
+	}
+
+	opened, err := openResponse(recipient, sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(opened, []byte("thesecret")) {
+		t.Errorf("expected opened response to hold the secret but got %s", opened)
+	}
+
+	other, err := nkeys.CreateCurveKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openResponse(other, sealed); err == nil {
+		t.Error("expected another key to be unable to open the response")
+	}
+
+	invalid := nats.NewMsg(subject)
+	invalid.Header.Set(RecipientKeyHeader, "not a key")
+	if code := requestMsgCode(t, nc, invalid); code != "400" {
+		t.Errorf("expected invalid recipient key to be rejected with 400 but got %s", code)
+	}
+}
+
+func requestMsgCode(t *testing.T, nc *nats.Conn, msg *nats.Msg) string {
+	t.Helper()
+	resp, err := nc.RequestMsg(msg, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp.Header.Get("Nats-Service-Error-Code")
+}
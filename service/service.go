@@ -1,6 +1,8 @@
 package service
 
 import (
+	"fmt"
+
 	"github.com/CoverWhale/logr"
 	"github.com/nats-io/nats.go/micro"
 )
@@ -16,7 +18,7 @@ func DBGroup(svc micro.Service, logger *logr.Logger, appCtx AppContext) {
 		micro.WithEndpointSubject(databaseInitSubject),
 	)
 	dbGroup.AddEndpoint("status",
-		AppHandler(logger, SecretHandler(Status), appCtx),
+		AppHandler(logger, Status, appCtx),
 		micro.WithEndpointMetadata(map[string]string{
 			"description": "returns the status of the database",
 			"format":      "application/json",
@@ -32,7 +34,7 @@ func DBGroup(svc micro.Service, logger *logr.Logger, appCtx AppContext) {
 		micro.WithEndpointSubject(databaseLockSubject),
 	)
 	dbGroup.AddEndpoint("unlock",
-		AppHandler(logger, Unlock, appCtx),
+		AppHandler(logger, AttemptHandler(Unlock), appCtx),
 		micro.WithEndpointMetadata(map[string]string{
 			"description": "unlocks the database",
 			"format":      "application/json",
@@ -40,13 +42,37 @@ func DBGroup(svc micro.Service, logger *logr.Logger, appCtx AppContext) {
 		micro.WithEndpointSubject(databaseUnlockSubject),
 	)
 	dbGroup.AddEndpoint("rotate",
-		AppHandler(logger, RotateKey, appCtx),
+		AppHandler(logger, AttemptHandler(RotateKey), appCtx),
 		micro.WithEndpointMetadata(map[string]string{
 			"description": "rotates the database encryption key",
 			"format":      "application/json",
 		}),
 		micro.WithEndpointSubject(databaseRotateSubject),
 	)
+	dbGroup.AddEndpoint("rotate-status",
+		AppHandler(logger, RotateStatus, appCtx),
+		micro.WithEndpointMetadata(map[string]string{
+			"description": "returns the progress of the current or last key rotation",
+			"format":      "application/json",
+		}),
+		micro.WithEndpointSubject(databaseRotateStatusSubject),
+	)
+	dbGroup.AddEndpoint("migrate",
+		AppHandler(logger, SecretHandler(MigrateRecords), appCtx),
+		micro.WithEndpointMetadata(map[string]string{
+			"description": "upgrades stored secrets to the latest record format",
+			"format":      "application/json",
+		}),
+		micro.WithEndpointSubject(databaseMigrateSubject),
+	)
+	dbGroup.AddEndpoint("rekey",
+		AppHandler(logger, SecretHandler(AttemptHandler(RekeyDatabase)), appCtx),
+		micro.WithEndpointMetadata(map[string]string{
+			"description": "replaces the material used to unlock the database",
+			"format":      "application/json",
+		}),
+		micro.WithEndpointSubject(databaseRekeySubject),
+	)
 }
 
 func AppGroup(svc micro.Service, logger *logr.Logger, appCtx AppContext) {
@@ -75,4 +101,74 @@ func AppGroup(svc micro.Service, logger *logr.Logger, appCtx AppContext) {
 		}),
 		micro.WithEndpointSubject("DELETE.>"),
 	)
+	appGroup.AddEndpoint("HISTORY",
+		AppHandler(logger, SecretHandler(HistoryRecord), appCtx),
+		micro.WithEndpointMetadata(map[string]string{
+			"description": "Lists the versions of a secret",
+			"format":      "application/json",
+		}),
+		micro.WithEndpointSubject("HISTORY.>"),
+	)
+	appGroup.AddEndpoint("ROLLBACK",
+		AppHandler(logger, SecretHandler(RollbackRecord), appCtx),
+		micro.WithEndpointMetadata(map[string]string{
+			"description": "Restores a previous version of a secret",
+			"format":      "application/json",
+		}),
+		micro.WithEndpointSubject("ROLLBACK.>"),
+	)
+	appGroup.AddEndpoint("META",
+		AppHandler(logger, MetaRecord, appCtx),
+		micro.WithEndpointMetadata(map[string]string{
+			"description": "Gets or updates the metadata of a secret",
+			"format":      "application/json",
+		}),
+		micro.WithEndpointSubject("META.>"),
+	)
+	appGroup.AddEndpoint("LIST",
+		AppHandler(logger, ListRecords, appCtx),
+		micro.WithEndpointMetadata(map[string]string{
+			"description": "Lists the secrets under a prefix",
+			"format":      "application/json",
+		}),
+		micro.WithEndpointSubject("LIST.>"),
+	)
+	appGroup.AddEndpoint("LIST_ALL",
+		AppHandler(logger, ListRecords, appCtx),
+		micro.WithEndpointMetadata(map[string]string{
+			"description": "Lists every secret",
+			"format":      "application/json",
+		}),
+		micro.WithEndpointSubject("LIST"),
+	)
+}
+
+// TransitGroup adds the endpoints that encrypt, HMAC and sign data with named transit keys without storing it
+func TransitGroup(svc micro.Service, logger *logr.Logger, appCtx AppContext) {
+	transitGroup := svc.AddGroup(transitSubject, micro.WithGroupQueueGroup("transit"))
+	endpoints := []struct {
+		verb        Verb
+		handler     AppHandlerFunc
+		description string
+	}{
+		{TransitCreate, CreateTransitKey, "Creates a transit key"},
+		{TransitRotate, RotateTransitKey, "Adds a new version to a transit key"},
+		{TransitEncrypt, EncryptTransit, "Encrypts data with a transit key"},
+		{TransitDecrypt, DecryptTransit, "Decrypts data encrypted with a transit key"},
+		{TransitRewrap, RewrapTransit, "Encrypts data again with the latest version of a transit key"},
+		{TransitHMAC, HMACTransit, "Returns an HMAC of data with a transit key"},
+		{TransitSign, SignTransit, "Signs data with a transit key"},
+		{TransitVerify, VerifyTransit, "Verifies a signature or HMAC made with a transit key"},
+	}
+
+	for _, v := range endpoints {
+		transitGroup.AddEndpoint(string(v.verb),
+			AppHandler(logger, SecretHandler(v.handler), appCtx),
+			micro.WithEndpointMetadata(map[string]string{
+				"description": v.description,
+				"format":      "application/json",
+			}),
+			micro.WithEndpointSubject(fmt.Sprintf("%s.>", v.verb)),
+		)
+	}
 }
@@ -0,0 +1,66 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CoverWhale/logr"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+// newTestService runs the database, secret and transit endpoints for a new bank and returns a connection to send requests with
+func newTestService(t *testing.T, configure ...func(*AppContext)) (AppContext, *nats.Conn) {
+	server := NewServer(t)
+	t.Cleanup(func() { shutdownJSServerAndRemoveStorage(t, server) })
+
+	nc, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := nc.JetStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kv, err := js.CreateKeyValue(&nats.KeyValueConfig{Bucket: "piggybank", History: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := NewAppContext(kv)
+	app.Conn = nc
+	app.logger = logr.NewLogger()
+	for _, v := range configure {
+		v(&app)
+	}
+
+	svc, err := micro.AddService(nc, micro.Config{Name: "piggybank", Version: "0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { svc.Stop() })
+
+	DBGroup(svc, app.logger, app)
+	AppGroup(svc, app.logger, app)
+	TransitGroup(svc, app.logger, app)
+
+	return app, nc
+}
+
+func requestCode(t *testing.T, nc *nats.Conn, subject string, data []byte) string {
+	t.Helper()
+	msg, err := nc.Request(subject, data, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := msg.Header.Get(micro.ErrorCodeHeader)
+	if code == "" {
+		return "200"
+	}
+
+	return code
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"crypto/rand"
+	"fmt"
+	"io"
+)
+
+const maxShares = 255
+
+// gfAdd adds two elements of GF(2^8)
+func gfAdd(a, b byte) byte {
+	return a ^ b
+}
+
+// gfMul multiplies two elements of GF(2^8) using the AES reducing polynomial
+func gfMul(a, b byte) byte {
+	var p byte
+	for i := 0; i < 8; i++ {
+		if b&1 == 1 {
+			p ^= a
+		}
+		hi := a & 0x80
+		a <<= 1
+		if hi == 0x80 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+
+	return p
+}
+
+// gfInv returns the multiplicative inverse of a in GF(2^8). Since a^255 == 1, a^254 is the inverse.
+func gfInv(a byte) byte {
+	result := a
+	for i := 0; i < 253; i++ {
+		result = gfMul(result, a)
+	}
+
+	return result
+}
+
+// gfDiv divides a by b in GF(2^8)
+func gfDiv(a, b byte) byte {
+	return gfMul(a, gfInv(b))
+}
+
+// evaluate returns the value of the polynomial with the given coefficients at x
+func evaluate(coefficients []byte, x byte) byte {
+	var result byte
+	for i := len(coefficients) - 1; i >= 0; i-- {
+		result = gfAdd(gfMul(result, x), coefficients[i])
+	}
+
+	return result
+}
+
+// splitSecret splits a secret into the requested number of shares, any threshold of which
+// can be combined to recover the secret. Each share is the y values for every byte of the
+// secret followed by a single byte x coordinate.
+func splitSecret(secret []byte, shares, threshold int) ([][]byte, error) {
+	if shares < 2 || shares > maxShares {
+		return nil, fmt.Errorf("shares must be between 2 and %d", maxShares)
+	}
+
+	if threshold < 2 || threshold > shares {
+		return nil, fmt.Errorf("threshold must be between 2 and the number of shares")
+	}
+
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("cannot split an empty secret")
+	}
+
+	out := make([][]byte, shares)
+	for i := range out {
+		out[i] = make([]byte, len(secret)+1)
+		out[i][len(secret)] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for i, b := range secret {
+		coefficients[0] = b
+		if _, err := io.ReadFull(rand.Reader, coefficients[1:]); err != nil {
+			return nil, err
+		}
+
+		for _, share := range out {
+			share[i] = evaluate(coefficients, share[len(secret)])
+		}
+	}
+
+	return out, nil
+}
+
+// combineShares recovers a secret from shares created by splitSecret using Lagrange
+// interpolation at x = 0. It is up to the caller to supply at least the threshold number of shares,
+// fewer shares will return an incorrect secret rather than an error.
+func combineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, fmt.Errorf("at least two shares are required")
+	}
+
+	size := len(shares[0])
+	if size < 2 {
+		return nil, fmt.Errorf("share is too short")
+	}
+
+	seen := map[byte]bool{}
+	xs := make([]byte, len(shares))
+	for i, share := range shares {
+		if len(share) != size {
+			return nil, fmt.Errorf("shares must be the same length")
+		}
+
+		x := share[size-1]
+		if x == 0 || seen[x] {
+			return nil, fmt.Errorf("invalid or duplicate share")
+		}
+		seen[x] = true
+		xs[i] = x
+	}
+
+	secret := make([]byte, size-1)
+	for i := range secret {
+		var value byte
+		for j, share := range shares {
+			basis := byte(1)
+			for k := range shares {
+				if j == k {
+					continue
+				}
+				basis = gfMul(basis, gfDiv(xs[k], gfAdd(xs[k], xs[j])))
+			}
+			value = gfAdd(value, gfMul(share[i], basis))
+		}
+		secret[i] = value
+	}
+
+	return secret, nil
+}
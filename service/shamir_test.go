@@ -0,0 +1,80 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	tt := []struct {
+		name      string
+		shares    int
+		threshold int
+		use       []int
+		match     bool
+	}{
+		{name: "exact threshold", shares: 5, threshold: 3, use: []int{0, 2, 4}, match: true},
+		{name: "all shares", shares: 5, threshold: 3, use: []int{0, 1, 2, 3, 4}, match: true},
+		{name: "two of two", shares: 2, threshold: 2, use: []int{1, 0}, match: true},
+		{name: "below threshold", shares: 5, threshold: 3, use: []int{1, 3}, match: false},
+	}
+
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			secret := generateKey()
+			shares, err := splitSecret(secret, v.shares, v.threshold)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(shares) != v.shares {
+				t.Fatalf("expected %d shares but got %d", v.shares, len(shares))
+			}
+
+			var subset [][]byte
+			for _, i := range v.use {
+				subset = append(subset, shares[i])
+			}
+
+			combined, err := combineShares(subset)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if bytes.Equal(combined, secret) != v.match {
+				t.Errorf("expected match to be %t", v.match)
+			}
+		})
+	}
+}
+
+func TestSplitInvalid(t *testing.T) {
+	tt := []struct {
+		name      string
+		shares    int
+		threshold int
+	}{
+		{name: "single share", shares: 1, threshold: 1},
+		{name: "threshold above shares", shares: 3, threshold: 4},
+		{name: "too many shares", shares: 256, threshold: 3},
+	}
+
+	for _, v := range tt {
+		t.Run(v.name, func(t *testing.T) {
+			if _, err := splitSecret(generateKey(), v.shares, v.threshold); err == nil {
+				t.Error("expected error but got nil")
+			}
+		})
+	}
+}
+
+func TestCombineDuplicate(t *testing.T) {
+	shares, err := splitSecret(generateKey(), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := combineShares([][]byte{shares[0], shares[0]}); err == nil {
+		t.Error("expected error for duplicate shares")
+	}
+}
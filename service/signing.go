@@ -0,0 +1,118 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	ResponseNonceHeader = "Piggybank-Response-Nonce"
+	SignatureHeader     = "Piggybank-Signature"
+)
+
+// ValidateSigner checks that the key pair can sign responses
+func ValidateSigner(kp nkeys.KeyPair) error {
+	public, err := kp.PublicKey()
+	if err != nil {
+		return err
+	}
+
+	if nkeys.Prefix(public) == nkeys.PrefixByteCurve {
+		return fmt.Errorf("a curve key cannot sign responses")
+	}
+
+	return nil
+}
+
+// responsePayload returns the data signed for a response. The request subject and the nonce sent by the
+// client are included so a signed response cannot be replayed to another request. Error responses include
+// the error code.
+func responsePayload(subject, nonce, code string, data []byte) []byte {
+	return append([]byte(fmt.Sprintf("%s\n%s\n%s\n", subject, nonce, code)), data...)
+}
+
+// signedRequest signs every response to the request with the service key
+type signedRequest struct {
+	micro.Request
+	signer nkeys.KeyPair
+}
+
+// sign returns the option that adds the signature header to the response
+func (s signedRequest) sign(code string, data []byte) (micro.RespondOpt, error) {
+	sig, err := s.signer.Sign(responsePayload(s.Subject(), s.Headers().Get(ResponseNonceHeader), code, data))
+	if err != nil {
+		return nil, err
+	}
+
+	header := micro.Headers{}
+	nats.Header(header).Set(SignatureHeader, base64.RawURLEncoding.EncodeToString(sig))
+
+	return micro.WithHeaders(header), nil
+}
+
+func (s signedRequest) Respond(data []byte, opts ...micro.RespondOpt) error {
+	opt, err := s.sign("", data)
+	if err != nil {
+		return err
+	}
+
+	return s.Request.Respond(data, append(opts, opt)...)
+}
+
+func (s signedRequest) RespondJSON(v any, opts ...micro.RespondOpt) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return micro.ErrMarshalResponse
+	}
+
+	return s.Respond(data, opts...)
+}
+
+func (s signedRequest) Error(code, description string, data []byte, opts ...micro.RespondOpt) error {
+	opt, err := s.sign(code, data)
+	if err != nil {
+		return err
+	}
+
+	return s.Request.Error(code, description, data, append(opts, opt)...)
+}
+
+// newResponseNonce returns a random nonce the service includes in the response signature
+func newResponseNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(nonce), nil
+}
+
+// verifyResponse checks that the response was signed by the service key for the request with the nonce
+func verifyResponse(servicePublic, subject, nonce string, msg *nats.Msg) error {
+	kp, err := nkeys.FromPublicKey(servicePublic)
+	if err != nil {
+		return fmt.Errorf("invalid service key: %w", err)
+	}
+
+	encoded := msg.Header.Get(SignatureHeader)
+	if encoded == "" {
+		return fmt.Errorf("unsigned response")
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid response signature")
+	}
+
+	if err := kp.Verify(responsePayload(subject, nonce, msg.Header.Get(micro.ErrorCodeHeader), msg.Data), sig); err != nil {
+		return fmt.Errorf("invalid response signature")
+	}
+
+	return nil
+}
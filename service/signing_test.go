@@ -0,0 +1,68 @@
+package service
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nats-io/nkeys"
+)
+
+func TestSignedResponses(t *testing.T) {
+	signer, err := nkeys.CreateServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := signer.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, nc := newTestService(t, func(a *AppContext) { a.Signer = signer })
+	status := Request{Subject: SubjectVerbs[DBStatus]}
+
+	client := Client{Conn: nc, ServiceKey: public}
+	if _, err := client.Do(status); err != nil {
+		t.Fatalf("expected signed response to verify: %v", err)
+	}
+
+	// error responses are signed too, so the service error is returned rather than a signature error
+	unlock, err := NewDBRequest(DBUnlock, toBase64(generateKey()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(unlock); err == nil || !strings.Contains(err.Error(), "status 400") {
+		t.Errorf("expected signed error response but got %v", err)
+	}
+
+	other, err := nkeys.CreateServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherPublic, err := other.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.ServiceKey = otherPublic
+	if _, err := client.Do(status); err == nil || err.Error() != "invalid response signature" {
+		t.Errorf("expected response signed by another key to be rejected but got %v", err)
+	}
+}
+
+func TestUnsignedResponse(t *testing.T) {
+	signer, err := nkeys.CreateServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	public, err := signer.PublicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, nc := newTestService(t)
+
+	client := Client{Conn: nc, ServiceKey: public}
+	if _, err := client.Do(Request{Subject: SubjectVerbs[DBStatus]}); err == nil || err.Error() != "unsigned response" {
+		t.Errorf("expected unsigned response to be rejected but got %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/CoverWhale/logr"
+	"github.com/nats-io/nats.go"
+)
+
+// systemPrefix is reserved for the records the service stores in the bucket for itself, such as the init
+// record, rotation checkpoint and failed attempts. Secrets cannot be stored under it.
+const (
+	systemPrefix = "_piggybank."
+	initKey      = systemPrefix + "init"
+)
+
+// legacyInitKey is where older versions stored the init record before it moved under the system prefix
+const legacyInitKey = "init"
+
+// systemKey returns true for keys under the reserved system prefix
+func systemKey(k string) bool {
+	return strings.HasPrefix(k, systemPrefix)
+}
+
+// secretKey returns the secret key from the request subject. Keys under the system prefix are rejected.
+func secretKey(subject string) (string, error) {
+	k := SanitizeKey(subject)
+	if systemKey(k) {
+		return "", NewClientError(fmt.Errorf("keys starting with %s are reserved", systemPrefix), 400)
+	}
+
+	return k, nil
+}
+
+// MigrateSystemKeys moves the init record written by older versions under the system prefix. Once the init record
+// is under the prefix, init is an ordinary secret name and is left alone.
+func (a *AppContext) MigrateSystemKeys(logger *logr.Logger) error {
+	if _, err := a.KV.Get(initKey); err != nats.ErrKeyNotFound {
+		return err
+	}
+
+	entry, err := a.KV.Get(legacyInitKey)
+	if err == nats.ErrKeyNotFound {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := a.KV.Create(initKey, entry.Value()); err != nil && !isRevisionConflict(err) {
+		return fmt.Errorf("error moving %s: %w", legacyInitKey, err)
+	}
+
+	if err := a.KV.Delete(legacyInitKey, nats.LastRevision(entry.Revision())); err != nil && !isRevisionConflict(err) {
+		return fmt.Errorf("error moving %s: %w", legacyInitKey, err)
+	}
+
+	logger.Infof("moved %s to %s", legacyInitKey, initKey)
+
+	return nil
+}
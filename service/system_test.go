@@ -0,0 +1,98 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/nats-io/nats.go"
+)
+
+func TestReservedKeys(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, verb := range []Verb{GET, POST, DELETE} {
+		if code := requestCode(t, nc, "piggybank.secrets."+string(verb)+"._piggybank.init", []byte("value")); code != "400" {
+			t.Errorf("expected %s of a reserved key to return 400 but got %q", verb, code)
+		}
+	}
+
+	// init is an ordinary secret name now that the init record is reserved
+	if code := requestCode(t, nc, "piggybank.secrets.POST.init", []byte("value")); code != "200" {
+		t.Errorf("expected secret named init to be stored but got %q", code)
+	}
+
+	app.Seal()
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Errorf("expected unlock to succeed after storing a secret named init: %v", err)
+	}
+}
+
+func TestMigrateSystemKeys(t *testing.T) {
+	app := newTestApp(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := app.KV.Get(initKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// lay the bucket out the way older versions did
+	if _, err := app.KV.Put(legacyInitKey, entry.Value()); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.KV.Delete(initKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// secrets stored at names system records never used are left where they are
+	secrets := map[string][]byte{"admin.db.password": []byte("1234"), "attempts": []byte(`{"failures":2}`)}
+	for k, v := range secrets {
+		if _, err := app.KV.Put(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := app.MigrateSystemKeys(app.logger); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.KV.Get(legacyInitKey); err != nats.ErrKeyNotFound {
+		t.Errorf("expected %s to be removed but got %v", legacyInitKey, err)
+	}
+
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Errorf("expected unlock with the moved init record: %v", err)
+	}
+
+	// once the init record is moved, init is an ordinary secret name
+	if _, err := app.KV.Put(legacyInitKey, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	secrets[legacyInitKey] = []byte("secret")
+
+	if err := app.MigrateSystemKeys(app.logger); err != nil {
+		t.Fatal(err)
+	}
+
+	for k, v := range secrets {
+		entry, err := app.KV.Get(k)
+		if err != nil || string(entry.Value()) != string(v) {
+			t.Errorf("expected secret %s to be left in place: %v", k, err)
+		}
+
+		if k != legacyInitKey {
+			if _, err := app.KV.Get(systemPrefix + k); err != nats.ErrKeyNotFound {
+				t.Errorf("expected secret %s not to be moved but got %v", k, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package service
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/micro"
+)
+
+const (
+	transitSubject          = "piggybank.transit"
+	transitKeyPrefix        = systemPrefix + "transit."
+	transitValuePrefix      = "piggybank"
+	TransitCreate      Verb = "CREATE"
+	TransitRotate      Verb = "ROTATE"
+	TransitEncrypt     Verb = "ENCRYPT"
+	TransitDecrypt     Verb = "DECRYPT"
+	TransitRewrap      Verb = "REWRAP"
+	TransitHMAC        Verb = "HMAC"
+	TransitSign        Verb = "SIGN"
+	TransitVerify      Verb = "VERIFY"
+)
+
+// transitKey is a named key used to encrypt, HMAC and sign data for clients without storing the data. Every
+// rotation adds a version, values produced by older versions can still be decrypted and verified and can be
+// rewrapped to the latest version. The key is stored sealed by the database key like a secret, so it is
+// rewrapped when the database key is rotated.
+type transitKey struct {
+	Latest   int                    `json:"latest"`
+	Versions map[int]transitVersion `json:"versions"`
+}
+
+// transitVersion holds the key material of one version of a transit key
+type transitVersion struct {
+	Key         []byte    `json:"key"`
+	SigningSeed []byte    `json:"signing_seed"`
+	Created     time.Time `json:"created"`
+}
+
+// TransitVerifyRequest holds the input and the signature or HMAC to check against it
+type TransitVerifyRequest struct {
+	Input     []byte `json:"input"`
+	Signature string `json:"signature,omitempty"`
+	HMAC      string `json:"hmac,omitempty"`
+}
+
+func newTransitVersion() transitVersion {
+	return transitVersion{
+		Key:         generateKey(),
+		SigningSeed: generateKey(),
+		Created:     time.Now(),
+	}
+}
+
+// rotate adds a new version and makes it the latest
+func (t *transitKey) rotate() {
+	if t.Versions == nil {
+		t.Versions = map[int]transitVersion{}
+	}
+
+	t.Latest++
+	t.Versions[t.Latest] = newTransitVersion()
+}
+
+// wipe zeroes the key material of every version
+func (t *transitKey) wipe() {
+	for _, v := range t.Versions {
+		zero(v.Key)
+		zero(v.SigningSeed)
+	}
+}
+
+// version returns the version used to produce a value
+func (t transitKey) version(version int) (transitVersion, error) {
+	v, ok := t.Versions[version]
+	if !ok {
+		return transitVersion{}, NewClientError(fmt.Errorf("transit key version %d not found", version), 400)
+	}
+
+	return v, nil
+}
+
+// formatTransitValue prefixes the value with the key version that produced it
+func formatTransitValue(version int, data []byte) string {
+	return fmt.Sprintf("%s:v%d:%s", transitValuePrefix, version, base64.StdEncoding.EncodeToString(data))
+}
+
+// parseTransitValue returns the key version and data of a value produced by a transit key
+func parseTransitValue(value string) (int, []byte, error) {
+	parts := strings.SplitN(strings.TrimSpace(value), ":", 3)
+	if len(parts) != 3 || parts[0] != transitValuePrefix || !strings.HasPrefix(parts[1], "v") {
+		return 0, nil, NewClientError(fmt.Errorf("invalid transit value"), 400)
+	}
+
+	version, err := strconv.Atoi(strings.TrimPrefix(parts[1], "v"))
+	if err != nil {
+		return 0, nil, NewClientError(fmt.Errorf("invalid transit value"), 400)
+	}
+
+	data, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, NewClientError(fmt.Errorf("invalid transit value"), 400)
+	}
+
+	return version, data, nil
+}
+
+// transitAAD binds ciphertext to the transit key name so it cannot be decrypted with another key
+func transitAAD(name string) []byte {
+	return []byte("piggybank transit:" + name)
+}
+
+func (t transitKey) encrypt(name string, plaintext []byte) (string, error) {
+	ciphertext, err := aesGCM{}.Seal(plaintext, t.Versions[t.Latest].Key, transitAAD(name))
+	if err != nil {
+		return "", err
+	}
+
+	return formatTransitValue(t.Latest, ciphertext), nil
+}
+
+func (t transitKey) decrypt(name, value string) ([]byte, error) {
+	version, ciphertext, err := parseTransitValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	v, err := t.version(version)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := aesGCM{}.Open(ciphertext, v.Key, transitAAD(name))
+	if err != nil {
+		return nil, NewClientError(fmt.Errorf("unable to decrypt transit value"), 400)
+	}
+
+	return plaintext, nil
+}
+
+// hmacKey derives the HMAC key of a version so it is never the same as its encryption key
+func (v transitVersion) hmacKey() []byte {
+	sum := sha256.Sum256(append([]byte("piggybank transit hmac:"), v.Key...))
+	return sum[:]
+}
+
+func (v transitVersion) mac(input []byte) []byte {
+	h := hmac.New(sha256.New, v.hmacKey())
+	h.Write(input)
+	return h.Sum(nil)
+}
+
+func (t transitKey) hmac(input []byte) string {
+	return formatTransitValue(t.Latest, t.Versions[t.Latest].mac(input))
+}
+
+func (t transitKey) sign(input []byte) string {
+	private := ed25519.NewKeyFromSeed(t.Versions[t.Latest].SigningSeed)
+	defer zero(private)
+
+	return formatTransitValue(t.Latest, ed25519.Sign(private, input))
+}
+
+// verify checks the signature or HMAC in the request against its input
+func (t transitKey) verify(req TransitVerifyRequest) (bool, error) {
+	value := req.Signature
+	if value == "" {
+		value = req.HMAC
+	}
+
+	if value == "" || (req.Signature != "" && req.HMAC != "") {
+		return false, NewClientError(fmt.Errorf("either a signature or an hmac is required"), 400)
+	}
+
+	version, data, err := parseTransitValue(value)
+	if err != nil {
+		return false, err
+	}
+
+	v, err := t.version(version)
+	if err != nil {
+		return false, err
+	}
+
+	if req.HMAC != "" {
+		return hmac.Equal(v.mac(req.Input), data), nil
+	}
+
+	private := ed25519.NewKeyFromSeed(v.SigningSeed)
+	defer zero(private)
+
+	return ed25519.Verify(private.Public().(ed25519.PublicKey), req.Input, data), nil
+}
+
+// transitName returns the transit key name from the request subject
+func transitName(subject string) (string, error) {
+	parts := strings.SplitN(subject, ".", 4)
+	if len(parts) != 4 || parts[3] == "" {
+		return "", NewClientError(fmt.Errorf("transit key name required"), 400)
+	}
+
+	return parts[3], nil
+}
+
+// getTransitKey opens the named transit key and returns it with its revision
+func (a *AppContext) getTransitKey(name string) (transitKey, uint64, error) {
+	entry, err := a.KV.Get(transitKeyPrefix + name)
+	if err == nats.ErrKeyNotFound {
+		return transitKey{}, 0, NewClientError(fmt.Errorf("transit key not found"), 404)
+	}
+
+	if err != nil {
+		return transitKey{}, 0, err
+	}
+
+	data, err := a.keys.open(entry.Key(), entry.Revision(), entry.Value())
+	if err != nil {
+		return transitKey{}, 0, err
+	}
+	defer zero(data)
+	a.keys.touch()
+
+	var key transitKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return transitKey{}, 0, err
+	}
+
+	return key, entry.Revision(), nil
+}
+
+// putTransitKey seals the transit key with the database key and stores it. A revision of 0 creates the key.
+func (a *AppContext) putTransitKey(name string, key transitKey, revision uint64) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	defer zero(data)
+
+	a.keys.change.RLock()
+	defer a.keys.change.RUnlock()
+
+	sealed, err := a.keys.seal(transitKeyPrefix+name, data)
+	if err != nil {
+		return err
+	}
+
+	if revision == 0 {
+		_, err = a.KV.Create(transitKeyPrefix+name, sealed)
+	} else {
+		_, err = a.KV.Update(transitKeyPrefix+name, sealed, revision)
+	}
+
+	if isRevisionConflict(err) && revision == 0 {
+		return NewClientError(fmt.Errorf("transit key already exists"), 409)
+	}
+
+	if isRevisionConflict(err) {
+		return NewClientError(fmt.Errorf("transit key changed, try again"), 409)
+	}
+
+	return err
+}
+
+// CreateTransitKey creates a new transit key
+func CreateTransitKey(r micro.Request, app AppContext) error {
+	name, err := transitName(r.Subject())
+	if err != nil {
+		return err
+	}
+
+	var key transitKey
+	key.rotate()
+	defer key.wipe()
+
+	if err := app.putTransitKey(name, key, 0); err != nil {
+		return err
+	}
+
+	return r.RespondJSON(ResponseMessage{Details: "transit key created"})
+}
+
+// RotateTransitKey adds a new version to a transit key. New values use the new version.
+func RotateTransitKey(r micro.Request, app AppContext) error {
+	name, err := transitName(r.Subject())
+	if err != nil {
+		return err
+	}
+
+	key, revision, err := app.getTransitKey(name)
+	if err != nil {
+		return err
+	}
+	defer key.wipe()
+
+	key.rotate()
+	if err := app.putTransitKey(name, key, revision); err != nil {
+		return err
+	}
+
+	return r.RespondJSON(ResponseMessage{Details: fmt.Sprintf("transit key rotated to version %d", key.Latest)})
+}
+
+// withTransitKey opens the transit key named in the request subject and passes it to fn. The key material
+// is zeroed when fn returns.
+func (a *AppContext) withTransitKey(r micro.Request, fn func(name string, key transitKey) error) error {
+	name, err := transitName(r.Subject())
+	if err != nil {
+		return err
+	}
+
+	key, _, err := a.getTransitKey(name)
+	if err != nil {
+		return err
+	}
+	defer key.wipe()
+
+	return fn(name, key)
+}
+
+// EncryptTransit encrypts the request data with the latest version of the transit key
+func EncryptTransit(r micro.Request, app AppContext) error {
+	return app.withTransitKey(r, func(name string, key transitKey) error {
+		ciphertext, err := key.encrypt(name, r.Data())
+		if err != nil {
+			return err
+		}
+
+		return r.RespondJSON(ResponseMessage{Details: ciphertext})
+	})
+}
+
+// DecryptTransit decrypts a value encrypted by any version of the transit key. The plaintext is returned base64
+// encoded without padding, so binary values survive the JSON response. The response is sealed to the recipient
+// key header if the client sent one.
+func DecryptTransit(r micro.Request, app AppContext) error {
+	return app.withTransitKey(r, func(name string, key transitKey) error {
+		plaintext, err := key.decrypt(name, string(r.Data()))
+		if err != nil {
+			return err
+		}
+		defer zero(plaintext)
+
+		return respondSealed(r, ResponseMessage{Details: toBase64(plaintext)})
+	})
+}
+
+// RewrapTransit encrypts a value again with the latest version of the transit key without returning the plaintext
+func RewrapTransit(r micro.Request, app AppContext) error {
+	return app.withTransitKey(r, func(name string, key transitKey) error {
+		plaintext, err := key.decrypt(name, string(r.Data()))
+		if err != nil {
+			return err
+		}
+		defer zero(plaintext)
+
+		ciphertext, err := key.encrypt(name, plaintext)
+		if err != nil {
+			return err
+		}
+
+		return r.RespondJSON(ResponseMessage{Details: ciphertext})
+	})
+}
+
+// HMACTransit returns an HMAC-SHA256 of the request data
+func HMACTransit(r micro.Request, app AppContext) error {
+	return app.withTransitKey(r, func(name string, key transitKey) error {
+		return r.RespondJSON(ResponseMessage{Details: key.hmac(r.Data())})
+	})
+}
+
+// SignTransit returns an Ed25519 signature of the request data
+func SignTransit(r micro.Request, app AppContext) error {
+	return app.withTransitKey(r, func(name string, key transitKey) error {
+		return r.RespondJSON(ResponseMessage{Details: key.sign(r.Data())})
+	})
+}
+
+// VerifyTransit checks a signature or HMAC produced by the transit key
+func VerifyTransit(r micro.Request, app AppContext) error {
+	var req TransitVerifyRequest
+	if err := json.Unmarshal(r.Data(), &req); err != nil {
+		return NewClientError(fmt.Errorf("bad request"), 400)
+	}
+
+	return app.withTransitKey(r, func(name string, key transitKey) error {
+		valid, err := key.verify(req)
+		if err != nil {
+			return err
+		}
+
+		details := "invalid"
+		if valid {
+			details = "valid"
+		}
+
+		return r.RespondJSON(ResponseMessage{Details: details, Valid: valid})
+	})
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestTransit(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{Conn: nc}
+	if err := client.CreateTransitKey("orders"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CreateTransitKey("orders"); err == nil {
+		t.Error("expected creating an existing transit key to fail")
+	}
+
+	ciphertext, err := client.TransitEncrypt("orders", []byte("4111111111111111"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mac, err := client.TransitHMAC("orders", []byte("input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := client.TransitSign("orders", []byte("input"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := client.RotateTransitKey("orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	// values from the first version still decrypt and verify after a rotation
+	plaintext, err := client.TransitDecrypt("orders", ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "4111111111111111" {
+		t.Errorf("expected 4111111111111111 but got %s", plaintext)
+	}
+
+	rewrapped, err := client.TransitRewrap("orders", ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version, _, err := parseTransitValue(rewrapped); err != nil || version != 2 {
+		t.Errorf("expected rewrapped value to use version 2 but got %s", rewrapped)
+	}
+
+	valid, err := client.TransitVerify("orders", []byte("input"), signature)
+	if err != nil || !valid {
+		t.Errorf("expected signature to verify: %v", err)
+	}
+
+	valid, err = client.TransitVerify("orders", []byte("other input"), signature)
+	if err != nil || valid {
+		t.Errorf("expected signature over other input to be invalid: %v", err)
+	}
+
+	valid, err = client.TransitVerifyHMAC("orders", []byte("input"), mac)
+	if err != nil || !valid {
+		t.Errorf("expected hmac to verify: %v", err)
+	}
+
+	// binary values are returned unchanged
+	binary := []byte{0xff, 0x00, 0xfe, 0x80}
+	ciphertext, err = client.TransitEncrypt("orders", binary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err = client.TransitDecrypt("orders", ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plaintext, binary) {
+		t.Errorf("expected %x but got %x", binary, plaintext)
+	}
+
+	// ciphertext is bound to the transit key that produced it
+	if err := client.CreateTransitKey("users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.TransitDecrypt("users", ciphertext); err == nil {
+		t.Error("expected ciphertext to fail to decrypt with another transit key")
+	}
+
+	if _, err := app.KV.Get("piggybank.transit.orders"); err == nil {
+		t.Error("expected transit data not to be stored")
+	}
+}
+
+func TestTransitKeyRotatedWithDatabaseKey(t *testing.T) {
+	app, nc := newTestService(t)
+	key, err := app.initialize(InitRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := app.unlock(unlockRequest(t, toBase64(key))); err != nil {
+		t.Fatal(err)
+	}
+
+	client := Client{Conn: nc}
+	if err := client.CreateTransitKey("orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	ciphertext, err := client.TransitEncrypt("orders", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.Rotate(RotateRequest{CurrentKey: toBase64(key)}); err != nil {
+		t.Fatal(err)
+	}
+	app.rotation.wait()
+
+	entry, err := app.KV.Get(transitKeyPrefix + "orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, ok := parseEnvelope(entry.Value())
+	if !ok || env.KeyID != app.keys.currentID() {
+		t.Error("expected transit key to be rewrapped with the new database key")
+	}
+
+	plaintext, err := client.TransitDecrypt("orders", ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plaintext) != "value" {
+		t.Errorf("expected value but got %s", plaintext)
+	}
+}